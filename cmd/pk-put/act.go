@@ -0,0 +1,150 @@
+/*
+Copyright 2026 The Perkeep Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+// This file implements the upload/revoke logic behind the -act,
+// -grant and -revoke flags that share.go registers on the "share"
+// subcommand: a ShareACT share hands the same content out to multiple
+// recipients via an access-control manifest (schema.ACTManifest)
+// instead of a single anonymously-readable target. The recipients are
+// named when the share is created; no recipient can be added to an
+// existing manifest. Revoking one recipient re-seals the content under
+// a fresh session key for all the others and yields a new manifest ref.
+//
+// The manifest's target blob is the plaintext sealed under the
+// manifest's own session key (schema.SealPayload), not the plaintext
+// itself: a grant only ever hands a recipient that session key, so an
+// unsealed target would make the manifest's per-recipient grants
+// decorative. Whether the sealed blob *also* ends up
+// envelope-encrypted at rest is a separate, independent property of
+// the server's configured storage chain (see
+// pkg/blobserver/encrypt/envelope), not something this command needs
+// to know about.
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+
+	"perkeep.org/pkg/blob"
+	"perkeep.org/pkg/blobserver"
+	"perkeep.org/pkg/schema"
+)
+
+// readPubKeyFile reads a hex-encoded X25519 public key from path (one
+// key per recipient file).
+func readPubKeyFile(path string) ([32]byte, error) {
+	var pub [32]byte
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return pub, fmt.Errorf("reading public key file %s: %v", path, err)
+	}
+	raw, err := hex.DecodeString(string(bytes.TrimSpace(data)))
+	if err != nil {
+		return pub, fmt.Errorf("public key file %s doesn't contain hex: %v", path, err)
+	}
+	if len(raw) != len(pub) {
+		return pub, fmt.Errorf("public key file %s has %d bytes, want %d", path, len(raw), len(pub))
+	}
+	copy(pub[:], raw)
+	return pub, nil
+}
+
+// uploadACTShare seals plaintext under a fresh session key and
+// uploads both it and an access-control manifest granting each of
+// recipients access to that key, returning the manifest blob's ref —
+// the ref a ShareACT claim's target points at.
+func uploadACTShare(ctx context.Context, up blobserver.Storage, plaintext []byte, recipients [][32]byte) (blob.Ref, error) {
+	sessionKey, err := schema.GenerateSessionKey()
+	if err != nil {
+		return blob.Ref{}, err
+	}
+	sealed, err := schema.SealPayload(sessionKey, plaintext)
+	if err != nil {
+		return blob.Ref{}, err
+	}
+	target := blob.RefFromBytes(sealed)
+	if _, err := blobserver.Receive(ctx, up, target, bytes.NewReader(sealed)); err != nil {
+		return blob.Ref{}, fmt.Errorf("uploading share target: %v", err)
+	}
+
+	manifest, err := schema.NewACTManifestForSessionKey(target, sessionKey, recipients...)
+	if err != nil {
+		return blob.Ref{}, err
+	}
+	return uploadManifest(ctx, up, manifest)
+}
+
+// revokeACTGrant rewrites the access-control manifest at manifestRef
+// to drop revoke: it generates a fresh session key, re-seals
+// plaintext under it (producing a new target ref wholly unrelated to
+// the old ciphertext a revoked recipient could still decrypt), and
+// uploads both the new target and the new manifest, returning the
+// manifest's ref.
+func revokeACTGrant(ctx context.Context, up blobserver.Storage, fetcher blob.Fetcher, manifestRef blob.Ref, plaintext []byte, revoke [32]byte) (blob.Ref, error) {
+	rc, _, err := fetcher.Fetch(ctx, manifestRef)
+	if err != nil {
+		return blob.Ref{}, fmt.Errorf("fetching existing access-control manifest: %v", err)
+	}
+	data, err := ioutil.ReadAll(rc)
+	rc.Close()
+	if err != nil {
+		return blob.Ref{}, err
+	}
+	manifest, err := schema.ParseACTManifest(data)
+	if err != nil {
+		return blob.Ref{}, err
+	}
+
+	keep, err := manifest.Revoke(revoke)
+	if err != nil {
+		return blob.Ref{}, err
+	}
+
+	sessionKey, err := schema.GenerateSessionKey()
+	if err != nil {
+		return blob.Ref{}, err
+	}
+	sealed, err := schema.SealPayload(sessionKey, plaintext)
+	if err != nil {
+		return blob.Ref{}, err
+	}
+	target := blob.RefFromBytes(sealed)
+	if _, err := blobserver.Receive(ctx, up, target, bytes.NewReader(sealed)); err != nil {
+		return blob.Ref{}, fmt.Errorf("uploading re-encrypted share target: %v", err)
+	}
+
+	revoked, err := schema.NewACTManifestForSessionKey(target, sessionKey, keep...)
+	if err != nil {
+		return blob.Ref{}, err
+	}
+	return uploadManifest(ctx, up, revoked)
+}
+
+func uploadManifest(ctx context.Context, up blobserver.Storage, manifest *schema.ACTManifest) (blob.Ref, error) {
+	manifestJSON, err := manifest.Encode()
+	if err != nil {
+		return blob.Ref{}, err
+	}
+	manifestRef := blob.RefFromBytes(manifestJSON)
+	if _, err := blobserver.Receive(ctx, up, manifestRef, bytes.NewReader(manifestJSON)); err != nil {
+		return blob.Ref{}, fmt.Errorf("uploading access-control manifest: %v", err)
+	}
+	return manifestRef, nil
+}
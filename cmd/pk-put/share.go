@@ -0,0 +1,119 @@
+/*
+Copyright 2026 The Perkeep Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io/ioutil"
+
+	"perkeep.org/pkg/blob"
+	"perkeep.org/pkg/cmdmain"
+)
+
+// shareCmd implements "pk-put share": upload a file and produce
+// something another Perkeep client can be given access to read. -act
+// turns it into a multi-recipient access-control share, readable only
+// by the recipients named with -grant, instead of a single
+// anonymously-readable target; -revoke drops one recipient from an
+// existing -act manifest named by -target.
+type shareCmd struct {
+	act    bool
+	grants grantFlag // paths to recipient X25519 public key files, one per -grant
+	revoke string    // path to a recipient's public key file to drop
+	target string    // blobref of the existing access-control manifest, required with -revoke
+}
+
+func init() {
+	cmdmain.RegisterCommand("share", func(flags *flag.FlagSet) cmdmain.CommandRunner {
+		cmd := new(shareCmd)
+		flags.BoolVar(&cmd.act, "act", false, "create a multi-recipient access-control share instead of a single anonymously-readable one")
+		flags.Var(&cmd.grants, "grant", "path to a recipient's X25519 public key file; repeat for multiple recipients (requires -act)")
+		flags.StringVar(&cmd.revoke, "revoke", "", "path to a recipient's X25519 public key file to drop from the manifest named by -target")
+		flags.StringVar(&cmd.target, "target", "", "blobref of the existing access-control manifest (required with -revoke)")
+		return cmd
+	})
+}
+
+// grantFlag implements flag.Value, letting -grant be repeated to
+// collect multiple recipient key file paths.
+type grantFlag []string
+
+func (f *grantFlag) String() string { return fmt.Sprint([]string(*f)) }
+func (f *grantFlag) Set(path string) error {
+	*f = append(*f, path)
+	return nil
+}
+
+func (c *shareCmd) RunCommand(args []string) error {
+	if !c.act {
+		return fmt.Errorf("pk-put share: only -act shares are implemented by this command")
+	}
+	if len(args) != 1 {
+		return fmt.Errorf("pk-put share -act: exactly one file argument (the plaintext to share) is required")
+	}
+	up := getUploader()
+	ctx := context.Background()
+
+	plaintext, err := ioutil.ReadFile(args[0])
+	if err != nil {
+		return fmt.Errorf("pk-put share: reading %s: %v", args[0], err)
+	}
+
+	if c.revoke != "" {
+		if c.target == "" {
+			return fmt.Errorf("pk-put share -revoke: -target is required")
+		}
+		manifestRef, ok := blob.Parse(c.target)
+		if !ok {
+			return fmt.Errorf("pk-put share -revoke: -target %q is not a valid blobref", c.target)
+		}
+		fetcher, ok := up.(blob.Fetcher)
+		if !ok {
+			return fmt.Errorf("pk-put share -revoke: uploader %T can't fetch the existing manifest back", up)
+		}
+		revokePub, err := readPubKeyFile(c.revoke)
+		if err != nil {
+			return err
+		}
+		newManifestRef, err := revokeACTGrant(ctx, up, fetcher, manifestRef, plaintext, revokePub)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("%s\n", newManifestRef)
+		return nil
+	}
+
+	if len(c.grants) == 0 {
+		return fmt.Errorf("pk-put share -act: at least one -grant is required")
+	}
+	recipients := make([][32]byte, len(c.grants))
+	for i, path := range c.grants {
+		pub, err := readPubKeyFile(path)
+		if err != nil {
+			return err
+		}
+		recipients[i] = pub
+	}
+	manifestRef, err := uploadACTShare(ctx, up, plaintext, recipients)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%s\n", manifestRef)
+	return nil
+}
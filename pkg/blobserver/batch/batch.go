@@ -0,0 +1,252 @@
+/*
+Copyright 2026 The Perkeep Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package batch implements a JSON batch transfer protocol, modeled
+// on Git LFS's batch API: a client POSTs the set of blobs it wants to
+// upload or download in one request, and gets back, per blob, either
+// an error or a short-lived signed URL to perform the actual
+// transfer against - which can point at an S3-backed endpoint
+// entirely bypassing the Perkeep server for the bulk of the bytes.
+//
+// Folding an upload's de-dup check (normally one StatBlobs round trip
+// per blob, or per small group of blobs) into a single request is the
+// main win: over a high-latency link, checking a large tree for
+// already-present blobs one at a time dominates the time an initial
+// import takes.
+package batch
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"perkeep.org/pkg/blob"
+	"perkeep.org/pkg/blobserver"
+	"perkeep.org/pkg/blobserver/handlers"
+)
+
+// Operation is the batch operation a client requests.
+type Operation string
+
+const (
+	OpUpload   Operation = "upload"
+	OpDownload Operation = "download"
+)
+
+// Object is one blob a client names in a Request, by ref and (for an
+// upload) its size.
+type Object struct {
+	Ref  blob.Ref `json:"ref"`
+	Size uint32   `json:"size,omitempty"`
+}
+
+// Request is the POST /camli/batch request body.
+type Request struct {
+	Operation Operation `json:"operation"`
+	Objects   []Object  `json:"objects"`
+}
+
+// Action is a single signed, short-lived HTTP action a client
+// performs to transfer one object's bytes: a PUT for an upload, a GET
+// for a download.
+type Action struct {
+	Href      string            `json:"href"`
+	Header    map[string]string `json:"header,omitempty"`
+	ExpiresAt time.Time         `json:"expires_at"`
+}
+
+// ObjectError explains why the server won't service one object of a
+// batch. Errors are reported per object, rather than failing the
+// whole request, so one bad ref (an unsupported hash, a quota limit)
+// doesn't block transfer of the rest.
+type ObjectError struct {
+	Code    int    `json:"code"` // an http.Status* code, as if this object had been requested on its own
+	Message string `json:"message"`
+}
+
+// ObjectResponse is one object's entry in a Response.
+type ObjectResponse struct {
+	Ref  blob.Ref `json:"ref"`
+	Size uint32   `json:"size,omitempty"`
+	// Actions is keyed by "upload" or "download". For an upload
+	// request, a ref the server already has comes back with neither
+	// Actions nor Error: there's nothing left to do for it.
+	Actions map[string]Action `json:"actions,omitempty"`
+	Error   *ObjectError      `json:"error,omitempty"`
+}
+
+// Response is the POST /camli/batch response body.
+type Response struct {
+	Objects []ObjectResponse `json:"objects"`
+}
+
+// defaultHrefTTL is how long a minted action href stays valid when
+// the Handler isn't configured with a different TTL.
+const defaultHrefTTL = 15 * time.Minute
+
+// Handler serves POST /camli/batch.
+type Handler struct {
+	// Storage is consulted via StatBlobs to tell which requested
+	// blobs the server already has.
+	Storage blobserver.Storage
+	// Secrets mints the query string of each action's href, the same
+	// way pkg/server's share signing does (see
+	// pkg/blobserver/handlers.SigningSecrets). The zero value leaves
+	// hrefs unsigned, which only makes sense if whatever serves them
+	// authorizes requests some other way: the handler
+	// handlers.CreateGetHandler returns falls back to its
+	// isGetAuthorized hook for an unsigned GET, but rejects every
+	// unsigned PUT.
+	Secrets handlers.SigningSecrets
+	// BaseURL is the scheme+host actual transfer hrefs are built
+	// under, e.g. "https://blobs.example.com" for a CDN/S3 endpoint
+	// that bypasses the Perkeep server for the transfer itself, or ""
+	// to build hrefs relative to this same server.
+	BaseURL string
+	// TTL overrides defaultHrefTTL when positive.
+	TTL time.Duration
+}
+
+func (h *Handler) ttl() time.Duration {
+	if h.TTL > 0 {
+		return h.TTL
+	}
+	return defaultHrefTTL
+}
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "batch: POST required", http.StatusMethodNotAllowed)
+		return
+	}
+	var req Request
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "batch: bad request body: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	switch req.Operation {
+	case OpUpload:
+		h.serveUpload(w, r, req.Objects)
+	case OpDownload:
+		h.serveDownload(w, r, req.Objects)
+	default:
+		http.Error(w, fmt.Sprintf("batch: unsupported operation %q", req.Operation), http.StatusBadRequest)
+	}
+}
+
+func (h *Handler) statPresence(r *http.Request, objs []Object) (map[blob.Ref]uint32, error) {
+	refs := make([]blob.Ref, len(objs))
+	for i, o := range objs {
+		refs[i] = o.Ref
+	}
+	present := make(map[blob.Ref]uint32, len(objs))
+	err := h.Storage.StatBlobs(r.Context(), refs, func(sb blob.SizedRef) error {
+		present[sb.Ref] = sb.Size
+		return nil
+	})
+	return present, err
+}
+
+func (h *Handler) serveUpload(w http.ResponseWriter, r *http.Request, objs []Object) {
+	present, err := h.statPresence(r, objs)
+	if err != nil {
+		http.Error(w, "batch: stat error: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	resp := Response{Objects: make([]ObjectResponse, 0, len(objs))}
+	for _, o := range objs {
+		if size, ok := present[o.Ref]; ok {
+			// Already have it: no action, nothing for the client to upload.
+			resp.Objects = append(resp.Objects, ObjectResponse{Ref: o.Ref, Size: size})
+			continue
+		}
+		action, err := h.action(OpUpload, o.Ref)
+		if err != nil {
+			resp.Objects = append(resp.Objects, ObjectResponse{
+				Ref: o.Ref, Size: o.Size,
+				Error: &ObjectError{Code: http.StatusInternalServerError, Message: err.Error()},
+			})
+			continue
+		}
+		resp.Objects = append(resp.Objects, ObjectResponse{
+			Ref: o.Ref, Size: o.Size,
+			Actions: map[string]Action{string(OpUpload): action},
+		})
+	}
+	writeJSON(w, resp)
+}
+
+func (h *Handler) serveDownload(w http.ResponseWriter, r *http.Request, objs []Object) {
+	present, err := h.statPresence(r, objs)
+	if err != nil {
+		http.Error(w, "batch: stat error: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	resp := Response{Objects: make([]ObjectResponse, 0, len(objs))}
+	for _, o := range objs {
+		size, ok := present[o.Ref]
+		if !ok {
+			resp.Objects = append(resp.Objects, ObjectResponse{
+				Ref:   o.Ref,
+				Error: &ObjectError{Code: http.StatusNotFound, Message: "blob not found"},
+			})
+			continue
+		}
+		action, err := h.action(OpDownload, o.Ref)
+		if err != nil {
+			resp.Objects = append(resp.Objects, ObjectResponse{
+				Ref: o.Ref, Size: size,
+				Error: &ObjectError{Code: http.StatusInternalServerError, Message: err.Error()},
+			})
+			continue
+		}
+		resp.Objects = append(resp.Objects, ObjectResponse{
+			Ref: o.Ref, Size: size,
+			Actions: map[string]Action{string(OpDownload): action},
+		})
+	}
+	writeJSON(w, resp)
+}
+
+// action mints the href+expiry for one object's transfer, signing the
+// query string exactly as pkg/server's share signing does, when
+// Secrets is configured.
+func (h *Handler) action(op Operation, ref blob.Ref) (Action, error) {
+	exp := time.Now().Add(h.ttl())
+	href := h.BaseURL + "/camli/" + ref.String()
+	if !h.Secrets.Zero() {
+		token, err := h.Secrets.Sign(ref, exp, string(op))
+		if err != nil {
+			return Action{}, err
+		}
+		v := url.Values{}
+		v.Set("sig", token)
+		v.Set("exp", strconv.FormatInt(exp.Unix(), 16))
+		v.Set("sub", string(op))
+		href += "?" + v.Encode()
+	}
+	return Action{Href: href, ExpiresAt: exp}, nil
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
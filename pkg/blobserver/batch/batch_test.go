@@ -0,0 +1,173 @@
+/*
+Copyright 2026 The Perkeep Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package batch
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"testing"
+
+	"perkeep.org/pkg/blob"
+	"perkeep.org/pkg/blobserver/handlers"
+)
+
+// memStorage is a minimal in-memory blobserver.Storage, just enough
+// to exercise the batch handler's StatBlobs-based de-dup in isolation.
+type memStorage struct {
+	blobs map[blob.Ref][]byte
+}
+
+func (m *memStorage) ReceiveBlob(ctx context.Context, br blob.Ref, source io.Reader) (blob.SizedRef, error) {
+	data, err := ioutil.ReadAll(source)
+	if err != nil {
+		return blob.SizedRef{}, err
+	}
+	m.blobs[br] = data
+	return blob.SizedRef{Ref: br, Size: uint32(len(data))}, nil
+}
+
+func (m *memStorage) Fetch(ctx context.Context, br blob.Ref) (io.ReadCloser, uint32, error) {
+	data, ok := m.blobs[br]
+	if !ok {
+		return nil, 0, os.ErrNotExist
+	}
+	return ioutil.NopCloser(bytes.NewReader(data)), uint32(len(data)), nil
+}
+
+func (m *memStorage) StatBlobs(ctx context.Context, blobs []blob.Ref, fn func(blob.SizedRef) error) error {
+	for _, br := range blobs {
+		if data, ok := m.blobs[br]; ok {
+			if err := fn(blob.SizedRef{Ref: br, Size: uint32(len(data))}); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (m *memStorage) EnumerateBlobs(ctx context.Context, dest chan<- blob.SizedRef, after string, limit int) error {
+	close(dest)
+	return nil
+}
+
+func (m *memStorage) RemoveBlobs(ctx context.Context, blobs []blob.Ref) error {
+	for _, br := range blobs {
+		delete(m.blobs, br)
+	}
+	return nil
+}
+
+func postBatch(t *testing.T, h *Handler, req Request) Response {
+	t.Helper()
+	body, err := json.Marshal(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr := httptest.NewRecorder()
+	httpReq := httptest.NewRequest("POST", "/camli/batch", bytes.NewReader(body))
+	h.ServeHTTP(rr, httpReq)
+	if rr.Code != 200 {
+		t.Fatalf("batch request failed: status %d, body %s", rr.Code, rr.Body)
+	}
+	var resp Response
+	if err := json.Unmarshal(rr.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("decoding batch response: %v; body=%s", err, rr.Body)
+	}
+	return resp
+}
+
+func TestHandler_UploadSkipsAlreadyPresentBlobs(t *testing.T) {
+	present := []byte("already here")
+	presentRef := blob.RefFromBytes(present)
+	missingRef := blob.RefFromBytes([]byte("not here yet"))
+
+	h := &Handler{Storage: &memStorage{blobs: map[blob.Ref][]byte{presentRef: present}}}
+	resp := postBatch(t, h, Request{
+		Operation: OpUpload,
+		Objects:   []Object{{Ref: presentRef, Size: uint32(len(present))}, {Ref: missingRef, Size: 12}},
+	})
+
+	byRef := make(map[blob.Ref]ObjectResponse)
+	for _, o := range resp.Objects {
+		byRef[o.Ref] = o
+	}
+	if got := byRef[presentRef]; got.Actions != nil || got.Error != nil {
+		t.Errorf("already-present blob got %+v, want no action and no error", got)
+	}
+	missing := byRef[missingRef]
+	if missing.Actions == nil || missing.Actions[string(OpUpload)].Href == "" {
+		t.Errorf("missing blob got %+v, want an upload action", missing)
+	}
+}
+
+func TestHandler_UploadSignsHrefWhenSecretsConfigured(t *testing.T) {
+	missingRef := blob.RefFromBytes([]byte("not here yet"))
+	h := &Handler{
+		Storage: &memStorage{blobs: map[blob.Ref][]byte{}},
+		Secrets: handlers.SigningSecrets{Current: "k1", Keys: map[string][]byte{"k1": []byte("secret")}},
+	}
+	resp := postBatch(t, h, Request{Operation: OpUpload, Objects: []Object{{Ref: missingRef, Size: 12}}})
+
+	action := resp.Objects[0].Actions[string(OpUpload)]
+	if action.Href == "" {
+		t.Fatal("expected an upload action")
+	}
+	u, err := url.Parse(action.Href)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.Query().Get("sig") == "" || u.Query().Get("exp") == "" {
+		t.Errorf("signed href %q missing sig/exp query params", action.Href)
+	}
+}
+
+func TestHandler_DownloadReportsMissingBlobAsError(t *testing.T) {
+	missingRef := blob.RefFromBytes([]byte("nope"))
+	h := &Handler{Storage: &memStorage{blobs: map[blob.Ref][]byte{}}}
+	resp := postBatch(t, h, Request{Operation: OpDownload, Objects: []Object{{Ref: missingRef}}})
+
+	if resp.Objects[0].Error == nil {
+		t.Fatal("expected an error entry for a blob the server doesn't have")
+	}
+	if resp.Objects[0].Error.Code != 404 {
+		t.Errorf("error code = %d, want 404", resp.Objects[0].Error.Code)
+	}
+}
+
+func TestHandler_DownloadReturnsActionForPresentBlob(t *testing.T) {
+	data := []byte("here it is")
+	ref := blob.RefFromBytes(data)
+	h := &Handler{Storage: &memStorage{blobs: map[blob.Ref][]byte{ref: data}}}
+	resp := postBatch(t, h, Request{Operation: OpDownload, Objects: []Object{{Ref: ref}}})
+
+	obj := resp.Objects[0]
+	if obj.Error != nil {
+		t.Fatalf("unexpected error: %+v", obj.Error)
+	}
+	if action := obj.Actions[string(OpDownload)]; action.Href == "" {
+		t.Error("expected a download action href")
+	}
+	if obj.Size != uint32(len(data)) {
+		t.Errorf("size = %d, want %d", obj.Size, len(data))
+	}
+}
@@ -0,0 +1,465 @@
+/*
+Copyright 2014 The Perkeep Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package envelope registers a "envelope" blobserver storage type,
+// which wraps another storage target and transparently encrypts every
+// blob with a fresh, per-blob symmetric key before it reaches the
+// wrapped target. It's intended for putting an otherwise-untrusted
+// bucket (e.g. a cheap or third-party S3-compatible endpoint) behind
+// a Perkeep server without trusting that bucket's operator with
+// plaintext.
+package envelope
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"sync"
+
+	"context"
+
+	"perkeep.org/pkg/blob"
+	"perkeep.org/pkg/blobserver"
+	"perkeep.org/pkg/blobserver/lockmgr"
+
+	"go4.org/jsonconfig"
+)
+
+const camliTypeEncryptKeys = "encrypt-keys"
+
+// alg identifies the scheme used to protect a blob, so a future
+// scheme change doesn't silently misinterpret old manifests.
+const alg = "aesctr+hmac-sha256"
+
+const (
+	aesKeySize = 32 // AES-256
+	macKeySize = 32 // HMAC-SHA256
+	ivSize     = aes.BlockSize
+)
+
+// keyManifest is the small schema blob written to the keys store for
+// every ciphertext blob. It carries everything needed to decrypt and
+// authenticate that one ciphertext, and the mapping back to the
+// plaintext ref it stands in for.
+type keyManifest struct {
+	CamliType     string `json:"camliType"`
+	Target        string `json:"target"`        // plaintext blob.Ref, as a string
+	TargetSize    uint32 `json:"targetSize"`     // size of the plaintext, in bytes
+	CiphertextRef string `json:"ciphertextRef"`  // blob.Ref of the ciphertext blob
+	Key           string `json:"key"`            // hex(aesKey || macKey)
+	MAC           string `json:"mac"`            // hex HMAC-SHA256(macKey, ciphertext)
+	Alg           string `json:"alg"`
+}
+
+func init() {
+	blobserver.RegisterStorageConstructor("envelope", blobserver.StorageConstructor(newFromConfig))
+}
+
+// storage is the "envelope" blobserver.Storage implementation.
+type storage struct {
+	// blobs is where ciphertext blobs are written; it can be an
+	// untrusted store, since it never sees plaintext or keys.
+	blobs blobserver.Storage
+	// keys is a small, trusted blob store for the per-blob key
+	// manifests. It's expected to hold many small blobs rather
+	// than the bulk data, so it's configured separately from blobs.
+	keys blobserver.Storage
+
+	// NoLocker: the envelope wrapper doesn't itself track advisory
+	// locks; a lock on a plaintext ref would need to be understood by
+	// whatever sync/GC pass is walking sto.blobs directly, which this
+	// wrapper has no visibility into.
+	lockmgr.NoLocker
+
+	mu      sync.Mutex
+	index   map[blob.Ref]indexEntry // plaintext ref -> its manifest
+	indexed bool                    // whether index has been built from sto.keys yet
+}
+
+// indexEntry is everything sto.index needs per plaintext ref to
+// answer both a manifestForPlain lookup (manifestRef, to fetch the
+// full keyManifest) and an EnumerateBlobs page (size, without
+// re-fetching and re-decoding that manifest).
+type indexEntry struct {
+	manifestRef blob.Ref
+	size        uint32
+}
+
+func newFromConfig(ld blobserver.Loader, config jsonconfig.Obj) (blobserver.Storage, error) {
+	blobsPrefix := config.RequiredString("blobs")
+	keysPrefix := config.RequiredString("keys")
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+	blobs, err := ld.GetStorage(blobsPrefix)
+	if err != nil {
+		return nil, fmt.Errorf("envelope: failed to load blobs storage %q: %v", blobsPrefix, err)
+	}
+	keys, err := ld.GetStorage(keysPrefix)
+	if err != nil {
+		return nil, fmt.Errorf("envelope: failed to load keys storage %q: %v", keysPrefix, err)
+	}
+	return &storage{
+		blobs: blobs,
+		keys:  keys,
+		index: make(map[blob.Ref]indexEntry),
+	}, nil
+}
+
+func (sto *storage) ReceiveBlob(ctx context.Context, br blob.Ref, source io.Reader) (blob.SizedRef, error) {
+	plaintext, err := ioutil.ReadAll(source)
+	if err != nil {
+		return blob.SizedRef{}, err
+	}
+	if got := blob.RefFromBytes(plaintext); got != br {
+		return blob.SizedRef{}, fmt.Errorf("envelope: blob data doesn't match declared ref %v (got %v)", br, got)
+	}
+
+	aesKey := make([]byte, aesKeySize)
+	macKey := make([]byte, macKeySize)
+	iv := make([]byte, ivSize)
+	for _, buf := range [][]byte{aesKey, macKey, iv} {
+		if _, err := io.ReadFull(rand.Reader, buf); err != nil {
+			return blob.SizedRef{}, fmt.Errorf("envelope: generating key material: %v", err)
+		}
+	}
+
+	block, err := aes.NewCipher(aesKey)
+	if err != nil {
+		return blob.SizedRef{}, err
+	}
+	ciphertext := make([]byte, ivSize+len(plaintext))
+	copy(ciphertext, iv)
+	cipher.NewCTR(block, iv).XORKeyStream(ciphertext[ivSize:], plaintext)
+
+	mac := hmac.New(sha256.New, macKey)
+	mac.Write(ciphertext)
+	macSum := mac.Sum(nil)
+
+	ciphertextRef := blob.RefFromBytes(ciphertext)
+	if _, err := blobserver.Receive(ctx, sto.blobs, ciphertextRef, bytes.NewReader(ciphertext)); err != nil {
+		return blob.SizedRef{}, fmt.Errorf("envelope: writing ciphertext blob: %v", err)
+	}
+
+	manifest := keyManifest{
+		CamliType:     camliTypeEncryptKeys,
+		Target:        br.String(),
+		TargetSize:    uint32(len(plaintext)),
+		CiphertextRef: ciphertextRef.String(),
+		Key:           hex.EncodeToString(append(append([]byte{}, aesKey...), macKey...)),
+		MAC:           hex.EncodeToString(macSum),
+		Alg:           alg,
+	}
+	manifestJSON, err := json.Marshal(manifest)
+	if err != nil {
+		return blob.SizedRef{}, err
+	}
+	manifestRef := blob.RefFromBytes(manifestJSON)
+	if _, err := blobserver.Receive(ctx, sto.keys, manifestRef, bytes.NewReader(manifestJSON)); err != nil {
+		return blob.SizedRef{}, fmt.Errorf("envelope: writing key manifest: %v", err)
+	}
+
+	sto.mu.Lock()
+	sto.index[br] = indexEntry{manifestRef: manifestRef, size: uint32(len(plaintext))}
+	sto.mu.Unlock()
+
+	return blob.SizedRef{Ref: br, Size: uint32(len(plaintext))}, nil
+}
+
+func (sto *storage) Fetch(ctx context.Context, br blob.Ref) (io.ReadCloser, uint32, error) {
+	manifest, _, err := sto.manifestForPlain(ctx, br)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	ciphertextRef, ok := blob.Parse(manifest.CiphertextRef)
+	if !ok {
+		return nil, 0, fmt.Errorf("envelope: malformed ciphertextRef in manifest for %v", br)
+	}
+	rc, _, err := sto.blobs.Fetch(ctx, ciphertextRef)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rc.Close()
+	ciphertext, err := ioutil.ReadAll(rc)
+	if err != nil {
+		return nil, 0, err
+	}
+	if len(ciphertext) < ivSize {
+		return nil, 0, fmt.Errorf("envelope: ciphertext for %v is too short", br)
+	}
+
+	keyBytes, err := hex.DecodeString(manifest.Key)
+	if err != nil || len(keyBytes) != aesKeySize+macKeySize {
+		return nil, 0, fmt.Errorf("envelope: malformed key in manifest for %v", br)
+	}
+	aesKey, macKey := keyBytes[:aesKeySize], keyBytes[aesKeySize:]
+
+	wantMAC, err := hex.DecodeString(manifest.MAC)
+	if err != nil {
+		return nil, 0, fmt.Errorf("envelope: malformed mac in manifest for %v", br)
+	}
+	mac := hmac.New(sha256.New, macKey)
+	mac.Write(ciphertext)
+	if !hmac.Equal(mac.Sum(nil), wantMAC) {
+		return nil, 0, fmt.Errorf("envelope: MAC verification failed for %v; ciphertext may be corrupt or tampered with", br)
+	}
+
+	block, err := aes.NewCipher(aesKey)
+	if err != nil {
+		return nil, 0, err
+	}
+	iv, body := ciphertext[:ivSize], ciphertext[ivSize:]
+	plaintext := make([]byte, len(body))
+	cipher.NewCTR(block, iv).XORKeyStream(plaintext, body)
+
+	if got := blob.RefFromBytes(plaintext); got != br {
+		return nil, 0, fmt.Errorf("envelope: decrypted plaintext for %v doesn't match its ref (got %v)", br, got)
+	}
+
+	return ioutil.NopCloser(bytes.NewReader(plaintext)), uint32(len(plaintext)), nil
+}
+
+func (sto *storage) StatBlobs(ctx context.Context, blobs []blob.Ref, fn func(blob.SizedRef) error) error {
+	for _, br := range blobs {
+		manifest, _, err := sto.manifestForPlain(ctx, br)
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if err := fn(blob.SizedRef{Ref: br, Size: manifest.TargetSize}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (sto *storage) EnumerateBlobs(ctx context.Context, dest chan<- blob.SizedRef, after string, limit int) error {
+	defer close(dest)
+	if err := sto.ensureIndexed(ctx); err != nil {
+		return err
+	}
+	// sto.index is unordered; sort on the plaintext ref before the
+	// after/limit pagination below relies on that order. This is a
+	// plain in-memory sort of refs already held in the index, not a
+	// re-fetch of every manifest blob, so it stays cheap across
+	// repeated pages of a paginated walk.
+	sorted := sto.sortedIndex()
+	n := 0
+	for _, e := range sorted {
+		if n >= limit {
+			return nil
+		}
+		if e.plain.String() <= after {
+			continue
+		}
+		select {
+		case dest <- blob.SizedRef{Ref: e.plain, Size: e.size}:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		n++
+	}
+	return nil
+}
+
+// plainSizedEntry is one row of the slice sortedIndex builds from
+// sto.index: enough to serve an EnumerateBlobs page without consulting
+// the keys store again.
+type plainSizedEntry struct {
+	plain blob.Ref
+	size  uint32
+}
+
+func (sto *storage) sortedIndex() []plainSizedEntry {
+	sto.mu.Lock()
+	entries := make([]plainSizedEntry, 0, len(sto.index))
+	for plain, e := range sto.index {
+		entries = append(entries, plainSizedEntry{plain: plain, size: e.size})
+	}
+	sto.mu.Unlock()
+	sort.Slice(entries, func(i, j int) bool { return entries[i].plain.String() < entries[j].plain.String() })
+	return entries
+}
+
+func (sto *storage) RemoveBlobs(ctx context.Context, blobs []blob.Ref) error {
+	for _, br := range blobs {
+		manifest, manifestRef, err := sto.manifestForPlain(ctx, br)
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		ciphertextRef, ok := blob.Parse(manifest.CiphertextRef)
+		if ok {
+			if err := sto.blobs.RemoveBlobs(ctx, []blob.Ref{ciphertextRef}); err != nil {
+				return err
+			}
+		}
+		if err := sto.keys.RemoveBlobs(ctx, []blob.Ref{manifestRef}); err != nil {
+			return err
+		}
+		sto.mu.Lock()
+		delete(sto.index, br)
+		sto.mu.Unlock()
+	}
+	return nil
+}
+
+// manifestForPlain returns the key manifest (and its own ref in the
+// keys store) for the given plaintext ref, building the in-memory
+// index from sto.keys first if this is the first lookup since sto was
+// constructed. A miss once the index is already built is trusted to
+// mean plain genuinely isn't one of ours, rather than re-triggering a
+// full walk of the keys store: see ensureIndexed.
+func (sto *storage) manifestForPlain(ctx context.Context, plain blob.Ref) (keyManifest, blob.Ref, error) {
+	if e, ok := sto.cachedEntry(plain); ok {
+		return sto.fetchManifest(ctx, e.manifestRef)
+	}
+	if err := sto.ensureIndexed(ctx); err != nil {
+		return keyManifest{}, blob.Ref{}, err
+	}
+	e, ok := sto.cachedEntry(plain)
+	if !ok {
+		return keyManifest{}, blob.Ref{}, os.ErrNotExist
+	}
+	return sto.fetchManifest(ctx, e.manifestRef)
+}
+
+func (sto *storage) cachedEntry(plain blob.Ref) (indexEntry, bool) {
+	sto.mu.Lock()
+	defer sto.mu.Unlock()
+	e, ok := sto.index[plain]
+	return e, ok
+}
+
+func (sto *storage) fetchManifest(ctx context.Context, manifestRef blob.Ref) (keyManifest, blob.Ref, error) {
+	rc, _, err := sto.keys.Fetch(ctx, manifestRef)
+	if err != nil {
+		return keyManifest{}, blob.Ref{}, err
+	}
+	defer rc.Close()
+	data, err := ioutil.ReadAll(rc)
+	if err != nil {
+		return keyManifest{}, blob.Ref{}, err
+	}
+	var manifest keyManifest
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return keyManifest{}, blob.Ref{}, fmt.Errorf("envelope: malformed key manifest %v: %v", manifestRef, err)
+	}
+	return manifest, manifestRef, nil
+}
+
+// ensureIndexed makes sure sto.index reflects at least one walk of
+// the keys store, performing that walk itself only the first time
+// it's called. Gating on sto.indexed this way is what keeps a cache
+// miss cheap: without it, every StatBlobs/Fetch/RemoveBlobs on a ref
+// this process hasn't seen yet (most obviously a ref that simply
+// doesn't exist) would re-trigger buildIndex, re-fetching and
+// re-JSON-decoding every manifest blob in the keys store from
+// scratch - turning a single existence check into O(n) work in the
+// number of blobs ever stored. The tradeoff is that a manifest
+// written by another process after this one last indexed won't be
+// found until this storage is recreated; nothing here currently needs
+// same-process visibility into another writer's blobs.
+func (sto *storage) ensureIndexed(ctx context.Context) error {
+	if sto.alreadyIndexed() {
+		return nil
+	}
+	return sto.buildIndex(ctx)
+}
+
+func (sto *storage) alreadyIndexed() bool {
+	sto.mu.Lock()
+	defer sto.mu.Unlock()
+	return sto.indexed
+}
+
+// buildIndex walks the entire keys store and populates sto.index. The
+// keys store is expected to hold only small manifest blobs, so a full
+// walk is cheap relative to the bulk ciphertext it protects - as long
+// as it only happens once per process lifetime; see ensureIndexed.
+func (sto *storage) buildIndex(ctx context.Context) error {
+	manifests, err := sto.allManifests(ctx)
+	if err != nil {
+		return err
+	}
+	sto.mu.Lock()
+	defer sto.mu.Unlock()
+	for _, mr := range manifests {
+		if plainRef, ok := blob.Parse(mr.manifest.Target); ok {
+			if _, ok := sto.index[plainRef]; !ok {
+				sto.index[plainRef] = indexEntry{manifestRef: mr.ref, size: mr.manifest.TargetSize}
+			}
+		}
+	}
+	sto.indexed = true
+	return nil
+}
+
+// manifestWithRef pairs a parsed keyManifest with the blob.Ref it was
+// actually stored under - the ref EnumerateBlobs already hands back
+// for free - so callers never need to re-derive it by re-marshaling
+// and re-hashing the parsed struct, which would only coincidentally
+// round-trip to the same ref and silently break the moment the
+// manifest schema grows an omitempty or reordered field.
+type manifestWithRef struct {
+	manifest keyManifest
+	ref      blob.Ref
+}
+
+func (sto *storage) allManifests(ctx context.Context) ([]manifestWithRef, error) {
+	dest := make(chan blob.SizedRef, 16)
+	errc := make(chan error, 1)
+	go func() {
+		errc <- sto.keys.EnumerateBlobs(ctx, dest, "", int(^uint(0)>>1))
+	}()
+	var manifests []manifestWithRef
+	for sb := range dest {
+		rc, _, err := sto.keys.Fetch(ctx, sb.Ref)
+		if err != nil {
+			return nil, err
+		}
+		data, err := ioutil.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			return nil, err
+		}
+		var m keyManifest
+		if err := json.Unmarshal(data, &m); err != nil || m.CamliType != camliTypeEncryptKeys {
+			continue
+		}
+		manifests = append(manifests, manifestWithRef{manifest: m, ref: sb.Ref})
+	}
+	if err := <-errc; err != nil {
+		return nil, err
+	}
+	return manifests, nil
+}
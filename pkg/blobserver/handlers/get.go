@@ -0,0 +1,157 @@
+/*
+Copyright 2026 The Perkeep Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package handlers implements the HTTP handlers that serve individual
+// blobs, as opposed to the higher-level sync and upload protocols.
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"perkeep.org/pkg/blob"
+)
+
+// receiver is the minimal capability CreateGetHandler needs to accept
+// a PUT upload: the single ReceiveBlob method blobserver.Storage
+// provides. Keeping this narrow, rather than requiring a full
+// Storage, lets the handler be constructed directly over any backend
+// that can receive blobs, the same way it only asks for a blob.Fetcher
+// to serve GETs.
+type receiver interface {
+	ReceiveBlob(ctx context.Context, br blob.Ref, source io.Reader) (blob.SizedRef, error)
+}
+
+// CreateGetHandler returns an http.Handler that serves GET and PUT
+// requests for a single blob named by the request path, e.g.
+// "/<ref>".
+//
+// A request carrying a valid "sig" query parameter (minted by
+// SigningSecrets.Sign, normally via a share's SignBlobRef, or via
+// pkg/blobserver/batch's upload/download actions) is served by
+// signature alone, bypassing isGetAuthorized entirely: this is what
+// lets a share recipient's browser, a CDN, or a batch-upload client
+// read or write blob bytes directly without an authenticated session
+// or a round trip through a proxy for every byte. Unsigned GETs fall
+// back to isGetAuthorized, which callers set to whatever auth chain
+// they'd otherwise apply (e.g. basic auth, or "is this ref reachable
+// from an authorized share"). PUT always requires a signature - there
+// is no isGetAuthorized-equivalent write check here - and is rejected
+// outright if receiver is nil, which disables uploads through this
+// handler entirely.
+func CreateGetHandler(fetcher blob.Fetcher, receiver receiver, secrets SigningSecrets, isGetAuthorized func(*http.Request) bool) http.Handler {
+	return &getHandler{fetcher: fetcher, receiver: receiver, secrets: secrets, isGetAuthorized: isGetAuthorized}
+}
+
+type getHandler struct {
+	fetcher         blob.Fetcher
+	receiver        receiver
+	secrets         SigningSecrets
+	isGetAuthorized func(*http.Request) bool
+}
+
+func (h *getHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	ref, ok := blob.Parse(strings.TrimPrefix(r.URL.Path, "/"))
+	if !ok {
+		http.Error(w, "bad blobref", http.StatusBadRequest)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		h.serveGet(w, r, ref)
+	case http.MethodPut:
+		h.servePut(w, r, ref)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (h *getHandler) serveGet(w http.ResponseWriter, r *http.Request, ref blob.Ref) {
+	if sig := r.FormValue("sig"); sig != "" {
+		if !h.checkSignedFetch(ref, sig, r) {
+			http.Error(w, "invalid or expired signature", http.StatusForbidden)
+			return
+		}
+	} else if h.isGetAuthorized == nil || !h.isGetAuthorized(r) {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	rc, size, err := h.fetcher.Fetch(r.Context(), ref)
+	if err != nil {
+		if err == context.Canceled {
+			return
+		}
+		http.Error(w, "blob not found", http.StatusNotFound)
+		return
+	}
+	defer rc.Close()
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Length", strconv.FormatUint(uint64(size), 10))
+	io.Copy(w, rc)
+}
+
+// servePut accepts a signed upload for ref, e.g. the PUT action
+// pkg/blobserver/batch mints for a blob the server doesn't have yet.
+// Unlike serveGet there's no unsigned fallback: a PUT reaching this
+// handler with no valid "sig" is simply rejected, since write access
+// has no isGetAuthorized-style hook to defer to here. The signature's
+// "sub" must additionally be "upload", so a signed download URL (sub
+// "download", or a share's unscoped sub) can't be replayed as a PUT to
+// write a blob it was only ever meant to let someone read.
+func (h *getHandler) servePut(w http.ResponseWriter, r *http.Request, ref blob.Ref) {
+	if h.receiver == nil {
+		http.Error(w, "uploads are not supported by this endpoint", http.StatusMethodNotAllowed)
+		return
+	}
+	sig := r.FormValue("sig")
+	if sig == "" || r.FormValue("sub") != "upload" || !h.checkSignedFetch(ref, sig, r) {
+		http.Error(w, "invalid, missing, or expired signature", http.StatusForbidden)
+		return
+	}
+	sb, err := h.receiver.ReceiveBlob(r.Context(), ref, r.Body)
+	if err != nil {
+		http.Error(w, "error receiving blob: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	fmt.Fprintf(w, `{"ref":%q,"size":%d}`, sb.Ref.String(), sb.Size)
+}
+
+// checkSignedFetch validates the "exp" and "sig" (and optional "sub")
+// query parameters against h.secrets, checking the cheap expiry first
+// so an expired token never reaches the constant-time HMAC
+// comparison.
+func (h *getHandler) checkSignedFetch(ref blob.Ref, sig string, r *http.Request) bool {
+	if h.secrets.Zero() {
+		return false
+	}
+	exp, err := strconv.ParseInt(r.FormValue("exp"), 16, 64)
+	if err != nil {
+		return false
+	}
+	if time.Now().Unix() > exp {
+		return false
+	}
+	return h.secrets.Verify(ref, sig, exp, r.FormValue("sub"))
+}
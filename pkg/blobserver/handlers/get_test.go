@@ -0,0 +1,260 @@
+/*
+Copyright 2026 The Perkeep Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+
+	"perkeep.org/pkg/blob"
+)
+
+type memFetcher map[blob.Ref][]byte
+
+func (m memFetcher) Fetch(ctx context.Context, br blob.Ref) (io.ReadCloser, uint32, error) {
+	data, ok := m[br]
+	if !ok {
+		return nil, 0, os.ErrNotExist
+	}
+	return ioutil.NopCloser(bytes.NewReader(data)), uint32(len(data)), nil
+}
+
+type memReceiver map[blob.Ref][]byte
+
+func (m memReceiver) ReceiveBlob(ctx context.Context, br blob.Ref, source io.Reader) (blob.SizedRef, error) {
+	data, err := ioutil.ReadAll(source)
+	if err != nil {
+		return blob.SizedRef{}, err
+	}
+	m[br] = data
+	return blob.SizedRef{Ref: br, Size: uint32(len(data))}, nil
+}
+
+func testSecrets() SigningSecrets {
+	return SigningSecrets{
+		Current: "k2",
+		Keys: map[string][]byte{
+			"k1": []byte("old-secret"),
+			"k2": []byte("new-secret"),
+		},
+	}
+}
+
+func TestGetHandler_UnsignedRequiresAuth(t *testing.T) {
+	data := []byte("hello")
+	ref := blob.RefFromBytes(data)
+	fetcher := memFetcher{ref: data}
+
+	for _, authorized := range []bool{false, true} {
+		h := CreateGetHandler(fetcher, nil, SigningSecrets{}, func(*http.Request) bool { return authorized })
+		rr := httptest.NewRecorder()
+		h.ServeHTTP(rr, httptest.NewRequest("GET", "/"+ref.String(), nil))
+		if authorized && rr.Code != http.StatusOK {
+			t.Errorf("authorized request: got status %d, want 200", rr.Code)
+		}
+		if !authorized && rr.Code == http.StatusOK {
+			t.Errorf("unauthorized request: got status 200, want rejection")
+		}
+	}
+}
+
+func TestGetHandler_SignedFetch(t *testing.T) {
+	data := []byte("hello, signed world")
+	ref := blob.RefFromBytes(data)
+	fetcher := memFetcher{ref: data}
+	secrets := testSecrets()
+
+	h := CreateGetHandler(fetcher, nil, secrets, func(*http.Request) bool { return false })
+
+	exp := time.Now().Add(time.Minute)
+	token, err := secrets.Sign(ref, exp, "claim-123")
+	if err != nil {
+		t.Fatal(err)
+	}
+	url := "/" + ref.String() + "?sig=" + token + "&exp=" + strconv.FormatInt(exp.Unix(), 16) + "&sub=claim-123"
+
+	rr := httptest.NewRecorder()
+	h.ServeHTTP(rr, httptest.NewRequest("GET", url, nil))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("signed request: got status %d, want 200; body=%s", rr.Code, rr.Body)
+	}
+	if got := rr.Body.String(); got != string(data) {
+		t.Errorf("body = %q, want %q", got, data)
+	}
+}
+
+func TestGetHandler_SignedFetchRejectsExpired(t *testing.T) {
+	data := []byte("expires soon")
+	ref := blob.RefFromBytes(data)
+	fetcher := memFetcher{ref: data}
+	secrets := testSecrets()
+	h := CreateGetHandler(fetcher, nil, secrets, func(*http.Request) bool { return false })
+
+	exp := time.Now().Add(-time.Minute)
+	token, err := secrets.Sign(ref, exp, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	url := "/" + ref.String() + "?sig=" + token + "&exp=" + strconv.FormatInt(exp.Unix(), 16)
+
+	rr := httptest.NewRecorder()
+	h.ServeHTTP(rr, httptest.NewRequest("GET", url, nil))
+	if rr.Code != http.StatusForbidden {
+		t.Errorf("expired signed request: got status %d, want 403", rr.Code)
+	}
+}
+
+func TestGetHandler_SignedFetchRejectsTamperedRef(t *testing.T) {
+	data := []byte("one blob")
+	other := []byte("a different blob")
+	ref := blob.RefFromBytes(data)
+	otherRef := blob.RefFromBytes(other)
+	fetcher := memFetcher{ref: data, otherRef: other}
+	secrets := testSecrets()
+	h := CreateGetHandler(fetcher, nil, secrets, func(*http.Request) bool { return false })
+
+	exp := time.Now().Add(time.Minute)
+	token, err := secrets.Sign(ref, exp, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Reuse a signature minted for ref against otherRef's URL.
+	url := "/" + otherRef.String() + "?sig=" + token + "&exp=" + strconv.FormatInt(exp.Unix(), 16)
+
+	rr := httptest.NewRecorder()
+	h.ServeHTTP(rr, httptest.NewRequest("GET", url, nil))
+	if rr.Code != http.StatusForbidden {
+		t.Errorf("tampered-ref request: got status %d, want 403", rr.Code)
+	}
+}
+
+func TestGetHandler_SignedPutReceivesBlob(t *testing.T) {
+	data := []byte("uploaded via batch action")
+	ref := blob.RefFromBytes(data)
+	fetcher := memFetcher{}
+	receiver := memReceiver{}
+	secrets := testSecrets()
+	h := CreateGetHandler(fetcher, receiver, secrets, func(*http.Request) bool { return false })
+
+	exp := time.Now().Add(time.Minute)
+	token, err := secrets.Sign(ref, exp, "upload")
+	if err != nil {
+		t.Fatal(err)
+	}
+	url := "/" + ref.String() + "?sig=" + token + "&exp=" + strconv.FormatInt(exp.Unix(), 16) + "&sub=upload"
+
+	rr := httptest.NewRecorder()
+	h.ServeHTTP(rr, httptest.NewRequest("PUT", url, bytes.NewReader(data)))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("signed PUT: got status %d, want 200; body=%s", rr.Code, rr.Body)
+	}
+	if got := receiver[ref]; !bytes.Equal(got, data) {
+		t.Errorf("receiver stored %q, want %q", got, data)
+	}
+}
+
+func TestGetHandler_UnsignedPutRejected(t *testing.T) {
+	data := []byte("no signature here")
+	ref := blob.RefFromBytes(data)
+	receiver := memReceiver{}
+	h := CreateGetHandler(memFetcher{}, receiver, testSecrets(), func(*http.Request) bool { return true })
+
+	rr := httptest.NewRecorder()
+	h.ServeHTTP(rr, httptest.NewRequest("PUT", "/"+ref.String(), bytes.NewReader(data)))
+	if rr.Code != http.StatusForbidden {
+		t.Errorf("unsigned PUT: got status %d, want 403", rr.Code)
+	}
+	if _, ok := receiver[ref]; ok {
+		t.Error("unsigned PUT should not have reached the receiver")
+	}
+}
+
+func TestGetHandler_PutRejectsDownloadScopedSignature(t *testing.T) {
+	data := []byte("a signed download URL, replayed as PUT")
+	ref := blob.RefFromBytes(data)
+	receiver := memReceiver{}
+	secrets := testSecrets()
+	h := CreateGetHandler(memFetcher{ref: data}, receiver, secrets, func(*http.Request) bool { return false })
+
+	exp := time.Now().Add(time.Minute)
+	token, err := secrets.Sign(ref, exp, "download")
+	if err != nil {
+		t.Fatal(err)
+	}
+	url := "/" + ref.String() + "?sig=" + token + "&exp=" + strconv.FormatInt(exp.Unix(), 16) + "&sub=download"
+
+	rr := httptest.NewRecorder()
+	h.ServeHTTP(rr, httptest.NewRequest("PUT", url, bytes.NewReader(data)))
+	if rr.Code != http.StatusForbidden {
+		t.Errorf("PUT with download-scoped signature: got status %d, want 403", rr.Code)
+	}
+	if _, ok := receiver[ref]; ok {
+		t.Error("download-scoped signature should not have reached the receiver")
+	}
+}
+
+func TestGetHandler_PutWithoutReceiverRejected(t *testing.T) {
+	data := []byte("nowhere to put this")
+	ref := blob.RefFromBytes(data)
+	secrets := testSecrets()
+	h := CreateGetHandler(memFetcher{}, nil, secrets, func(*http.Request) bool { return false })
+
+	exp := time.Now().Add(time.Minute)
+	token, err := secrets.Sign(ref, exp, "upload")
+	if err != nil {
+		t.Fatal(err)
+	}
+	url := "/" + ref.String() + "?sig=" + token + "&exp=" + strconv.FormatInt(exp.Unix(), 16) + "&sub=upload"
+
+	rr := httptest.NewRecorder()
+	h.ServeHTTP(rr, httptest.NewRequest("PUT", url, bytes.NewReader(data)))
+	if rr.Code != http.StatusMethodNotAllowed {
+		t.Errorf("PUT with nil receiver: got status %d, want 405", rr.Code)
+	}
+}
+
+func TestSigningSecrets_RotationStillVerifiesOldKid(t *testing.T) {
+	ref := blob.RefFromBytes([]byte("rotation"))
+	old := SigningSecrets{Current: "k1", Keys: map[string][]byte{"k1": []byte("old-secret")}}
+	exp := time.Now().Add(time.Minute)
+	token, err := old.Sign(ref, exp, "sub")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rotated := testSecrets() // Current is now "k2", but "k1" is still present
+	if !rotated.Verify(ref, token, exp.Unix(), "sub") {
+		t.Error("signature minted under retired kid k1 should still verify after rotation")
+	}
+}
+
+func TestSigningSecrets_VerifyRejectsUnknownKid(t *testing.T) {
+	ref := blob.RefFromBytes([]byte("x"))
+	s := testSecrets()
+	exp := time.Now().Add(time.Minute)
+	if s.Verify(ref, "nosuchkid:deadbeef", exp.Unix(), "") {
+		t.Error("Verify should reject a token with an unknown kid")
+	}
+}
@@ -0,0 +1,118 @@
+/*
+Copyright 2026 The Perkeep Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package handlers
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"time"
+
+	"perkeep.org/pkg/blob"
+)
+
+// defaultSigBytes is the number of bytes of the HMAC-SHA256 digest
+// kept in a signed fetch URL when SigningSecrets.SigBytes isn't set.
+// It's deliberately short to keep URLs tidy; 10 bytes (20 hex chars)
+// is still far too large to brute-force.
+const defaultSigBytes = 10
+
+// SigningSecrets is the set of HMAC keys used to mint and verify
+// time-limited direct-fetch URLs for blob content, keyed by a short
+// key ID ("kid"). New URLs are always signed with the key named by
+// Current, but Verify accepts a signature produced by any key still
+// present in Keys, so a secret can be rotated (by adding a new
+// Current and leaving the old kid in Keys) without invalidating
+// already-minted URLs that haven't expired yet.
+type SigningSecrets struct {
+	Current string            // kid of the key Sign uses
+	Keys    map[string][]byte // kid -> secret
+
+	// SigBytes is the number of bytes of the HMAC-SHA256 digest kept
+	// in a signed token. Zero means defaultSigBytes.
+	SigBytes int
+}
+
+// Zero reports whether s has no usable signing key, i.e. signed
+// direct-fetch URLs are disabled.
+func (s SigningSecrets) Zero() bool {
+	return s.Current == "" || len(s.Keys[s.Current]) == 0
+}
+
+func (s SigningSecrets) sigBytes() int {
+	switch {
+	case s.SigBytes <= 0:
+		return defaultSigBytes
+	case s.SigBytes > sha256.Size:
+		// A misconfigured SigBytes shouldn't be able to panic Sign/Verify;
+		// signingSecretsFromConfig already rejects this at load time, but
+		// SigningSecrets can also be built directly by a caller that
+		// skips that validation.
+		return sha256.Size
+	default:
+		return s.SigBytes
+	}
+}
+
+func mac(key []byte, ref blob.Ref, exp int64, subject string, sigBytes int) []byte {
+	h := hmac.New(sha256.New, key)
+	fmt.Fprintf(h, "%s@%x@%s", ref.String(), exp, subject)
+	sum := h.Sum(nil)
+	if sigBytes > len(sum) {
+		sigBytes = len(sum)
+	}
+	return sum[:sigBytes]
+}
+
+// Sign returns the "kid:sig" token for a direct-fetch URL granting
+// access to ref until exp, scoped to subject (typically the blobref
+// of the share claim that authorized the fetch, so a token minted for
+// one share can't be replayed against another). The caller is
+// responsible for also carrying exp and, if non-empty, subject in the
+// URL, since both are inputs to the signature that Verify recomputes.
+func (s SigningSecrets) Sign(ref blob.Ref, exp time.Time, subject string) (string, error) {
+	key, ok := s.Keys[s.Current]
+	if !ok || len(key) == 0 {
+		return "", fmt.Errorf("handlers: no signing key for kid %q", s.Current)
+	}
+	sig := mac(key, ref, exp.Unix(), subject, s.sigBytes())
+	return s.Current + ":" + hex.EncodeToString(sig), nil
+}
+
+// Verify reports whether token is a signature minted by Sign (with
+// any key still in s.Keys) over ref, exp, and subject. It does not
+// check whether exp has already passed; callers check expiry first,
+// since that's a cheap check that should short-circuit before the
+// HMAC comparison below.
+func (s SigningSecrets) Verify(ref blob.Ref, token string, exp int64, subject string) bool {
+	kid, sigHex, ok := strings.Cut(token, ":")
+	if !ok {
+		return false
+	}
+	key, ok := s.Keys[kid]
+	if !ok || len(key) == 0 {
+		return false
+	}
+	got, err := hex.DecodeString(sigHex)
+	if err != nil || len(got) != s.sigBytes() {
+		return false
+	}
+	want := mac(key, ref, exp, subject, s.sigBytes())
+	return hmac.Equal(got, want)
+}
@@ -0,0 +1,86 @@
+/*
+Copyright 2026 The Perkeep Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package lockmgr
+
+import (
+	"context"
+	"fmt"
+
+	"perkeep.org/pkg/blob"
+	"perkeep.org/pkg/blobserver"
+)
+
+// SkipLocked is the hook a sync or GC pass calls immediately before
+// deleting or replicating refs out of storage: it splits refs into the
+// subset still safe to act on and the subset a live advisory lock is
+// currently protecting, so the caller can skip (and log or retry) the
+// locked ones instead of tearing a blob out from under whoever holds
+// the lock.
+//
+// storage not implementing Locker means nothing in front of it ever
+// takes a lock, so every ref comes back safe; the same holds for a
+// storage embedding NoLocker, whose Locked never reports a lock. Callers should call this right before the destructive
+// step, not earlier in a long-running pass, since a lock taken after
+// refs was first gathered must still be honored.
+func SkipLocked(storage blobserver.Storage, refs []blob.Ref) (safe []blob.Ref, locked map[blob.Ref]Lock) {
+	locker, ok := storage.(Locker)
+	if !ok {
+		return refs, nil
+	}
+	safe = make([]blob.Ref, 0, len(refs))
+	for _, ref := range refs {
+		if l, ok := locker.Locked(ref); ok {
+			if locked == nil {
+				locked = make(map[blob.Ref]Lock)
+			}
+			locked[ref] = l
+			continue
+		}
+		safe = append(safe, ref)
+	}
+	return safe, locked
+}
+
+// RemoveBlobsError reports refs RemoveBlobsSkippingLocked declined to
+// delete because SkipLocked found them locked.
+type RemoveBlobsError struct {
+	Locked map[blob.Ref]Lock
+}
+
+func (e *RemoveBlobsError) Error() string {
+	return fmt.Sprintf("lockmgr: %d blobs were skipped because they're locked", len(e.Locked))
+}
+
+// RemoveBlobsSkippingLocked is what a sync or GC pass should call
+// instead of storage.RemoveBlobs directly when it's about to delete
+// refs out of storage: it consults SkipLocked first, deletes only the
+// refs that come back safe, and reports the locked ones back to the
+// caller (as a *RemoveBlobsError, or folded into storage.RemoveBlobs's
+// own error if that also failed) instead of silently dropping them
+// from the batch.
+func RemoveBlobsSkippingLocked(ctx context.Context, storage blobserver.Storage, refs []blob.Ref) error {
+	safe, locked := SkipLocked(storage, refs)
+	err := storage.RemoveBlobs(ctx, safe)
+	switch {
+	case len(locked) == 0:
+		return err
+	case err != nil:
+		return fmt.Errorf("%v; additionally, %d blobs were skipped because they're locked", err, len(locked))
+	default:
+		return &RemoveBlobsError{Locked: locked}
+	}
+}
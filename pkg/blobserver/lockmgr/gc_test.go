@@ -0,0 +1,108 @@
+/*
+Copyright 2026 The Perkeep Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package lockmgr
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"perkeep.org/pkg/blob"
+)
+
+// lockingMemStorage is a blobserver.Storage that also implements
+// Locker, the way a real storage wanting lock support would: by
+// embedding a *Manager alongside its usual storage plumbing.
+type lockingMemStorage struct {
+	*memStorage
+	*Manager
+}
+
+func TestSkipLocked_SplitsLockedFromSafe(t *testing.T) {
+	sto := &lockingMemStorage{memStorage: &memStorage{blobs: map[blob.Ref][]byte{}}, Manager: New()}
+	ctx := context.Background()
+
+	locked := blob.RefFromBytes([]byte("locked"))
+	unlocked := blob.RefFromBytes([]byte("unlocked"))
+	if _, err := sto.SetLock(ctx, locked, "fsck", time.Minute); err != nil {
+		t.Fatal(err)
+	}
+
+	safe, lockedBy := SkipLocked(sto, []blob.Ref{locked, unlocked})
+	if len(safe) != 1 || safe[0] != unlocked {
+		t.Errorf("safe = %v, want [%v]", safe, unlocked)
+	}
+	if _, ok := lockedBy[locked]; !ok || len(lockedBy) != 1 {
+		t.Errorf("lockedBy = %v, want exactly %v", lockedBy, locked)
+	}
+}
+
+func TestRemoveBlobsSkippingLocked_SkipsLockedBlobs(t *testing.T) {
+	sto := &lockingMemStorage{memStorage: &memStorage{blobs: map[blob.Ref][]byte{}}, Manager: New()}
+	ctx := context.Background()
+
+	locked := blob.RefFromBytes([]byte("locked"))
+	unlocked := blob.RefFromBytes([]byte("unlocked"))
+	sto.blobs[locked] = []byte("locked")
+	sto.blobs[unlocked] = []byte("unlocked")
+	if _, err := sto.SetLock(ctx, locked, "fsck", time.Minute); err != nil {
+		t.Fatal(err)
+	}
+
+	err := RemoveBlobsSkippingLocked(ctx, sto, []blob.Ref{locked, unlocked})
+	rbErr, ok := err.(*RemoveBlobsError)
+	if !ok {
+		t.Fatalf("got error of type %T, want *RemoveBlobsError", err)
+	}
+	if _, ok := rbErr.Locked[locked]; !ok || len(rbErr.Locked) != 1 {
+		t.Errorf("Locked = %v, want exactly %v", rbErr.Locked, locked)
+	}
+
+	if _, ok := sto.blobs[locked]; !ok {
+		t.Error("locked blob was deleted, want it left alone")
+	}
+	if _, ok := sto.blobs[unlocked]; ok {
+		t.Error("unlocked blob was not deleted")
+	}
+}
+
+func TestRemoveBlobsSkippingLocked_NoLocksDeletesEverything(t *testing.T) {
+	sto := &memStorage{blobs: map[blob.Ref][]byte{}}
+	a, b := blob.RefFromBytes([]byte("a")), blob.RefFromBytes([]byte("b"))
+	sto.blobs[a] = []byte("a")
+	sto.blobs[b] = []byte("b")
+
+	if err := RemoveBlobsSkippingLocked(context.Background(), sto, []blob.Ref{a, b}); err != nil {
+		t.Fatalf("RemoveBlobsSkippingLocked: %v", err)
+	}
+	if len(sto.blobs) != 0 {
+		t.Errorf("blobs remaining = %v, want none", sto.blobs)
+	}
+}
+
+func TestSkipLocked_PassesEverythingThroughWhenStorageDoesNotSupportLocks(t *testing.T) {
+	sto := &memStorage{blobs: map[blob.Ref][]byte{}}
+	refs := []blob.Ref{blob.RefFromBytes([]byte("a")), blob.RefFromBytes([]byte("b"))}
+
+	safe, lockedBy := SkipLocked(sto, refs)
+	if len(safe) != len(refs) {
+		t.Errorf("safe = %v, want all of %v", safe, refs)
+	}
+	if len(lockedBy) != 0 {
+		t.Errorf("lockedBy = %v, want empty", lockedBy)
+	}
+}
@@ -0,0 +1,123 @@
+/*
+Copyright 2026 The Perkeep Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package lockmgr
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+
+	"perkeep.org/pkg/blob"
+)
+
+// defaultTTL is used when a /camli/lock/set or /refresh request
+// doesn't specify one.
+const defaultTTL = 5 * time.Minute
+
+// Handler returns an http.Handler serving the lock HTTP surface at
+// three paths: "/set", "/refresh", and "/unlock", each taking a
+// "blobref" form value plus whatever SetLock/RefreshLock/Unlock
+// additionally need ("holder" for set, "ttl" seconds for set and
+// refresh, "token" for refresh and unlock). It's meant to be
+// mounted under something like "/camli/lock/", so external tools (an
+// fsck-in-progress, an active FUSE mount) can pin a blob against a
+// concurrent sync or GC pass without going through the full upload
+// protocol.
+func (m *Manager) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/set", m.serveSet)
+	mux.HandleFunc("/refresh", m.serveRefresh)
+	mux.HandleFunc("/unlock", m.serveUnlock)
+	return mux
+}
+
+type lockResponse struct {
+	Token string `json:"token,omitempty"`
+	Error string `json:"error,omitempty"`
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func parseRef(r *http.Request) (blob.Ref, bool) {
+	return blob.Parse(r.FormValue("blobref"))
+}
+
+func parseTTL(r *http.Request) time.Duration {
+	secs, err := strconv.Atoi(r.FormValue("ttl"))
+	if err != nil || secs <= 0 {
+		return defaultTTL
+	}
+	return time.Duration(secs) * time.Second
+}
+
+func (m *Manager) serveSet(w http.ResponseWriter, r *http.Request) {
+	ref, ok := parseRef(r)
+	if !ok {
+		writeJSON(w, http.StatusBadRequest, lockResponse{Error: "bad or missing blobref"})
+		return
+	}
+	token, err := m.SetLock(r.Context(), ref, r.FormValue("holder"), parseTTL(r))
+	if err != nil {
+		writeJSON(w, statusForErr(err), lockResponse{Error: err.Error()})
+		return
+	}
+	writeJSON(w, http.StatusOK, lockResponse{Token: token})
+}
+
+func (m *Manager) serveRefresh(w http.ResponseWriter, r *http.Request) {
+	ref, ok := parseRef(r)
+	if !ok {
+		writeJSON(w, http.StatusBadRequest, lockResponse{Error: "bad or missing blobref"})
+		return
+	}
+	err := m.RefreshLock(r.Context(), ref, r.FormValue("token"), parseTTL(r))
+	if err != nil {
+		writeJSON(w, statusForErr(err), lockResponse{Error: err.Error()})
+		return
+	}
+	writeJSON(w, http.StatusOK, lockResponse{})
+}
+
+func (m *Manager) serveUnlock(w http.ResponseWriter, r *http.Request) {
+	ref, ok := parseRef(r)
+	if !ok {
+		writeJSON(w, http.StatusBadRequest, lockResponse{Error: "bad or missing blobref"})
+		return
+	}
+	err := m.Unlock(r.Context(), ref, r.FormValue("token"))
+	if err != nil {
+		writeJSON(w, statusForErr(err), lockResponse{Error: err.Error()})
+		return
+	}
+	writeJSON(w, http.StatusOK, lockResponse{})
+}
+
+func statusForErr(err error) int {
+	switch err {
+	case ErrLocked:
+		return http.StatusConflict
+	case ErrTokenMismatch, ErrNotLocked:
+		return http.StatusForbidden
+	default:
+		return http.StatusInternalServerError
+	}
+}
@@ -0,0 +1,276 @@
+/*
+Copyright 2026 The Perkeep Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package lockmgr implements blob-level advisory locks, so that a
+// long-running external process (an fsck-in-progress, an active FUSE
+// mount reading a blob it already resolved) can pin a blob against a
+// concurrent "camtool sync --delete-on-src" or GC pass deleting or
+// replicating it out from under them.
+//
+// It's deliberately modeled on decomposedfs's application-level
+// locks: a lock is {ref, holder, token, expires}, SetLock fails with
+// ErrLocked if a live lock held by a different holder already exists,
+// RefreshLock only extends the expiry if the caller presents the
+// token SetLock returned, and Unlock requires that same token. A
+// blobserver.Storage implementation that wants this capability
+// embeds a *Manager (see NoLocker for the zero-cost default for
+// implementations that don't).
+package lockmgr
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"sync"
+	"time"
+
+	"perkeep.org/pkg/blob"
+	"perkeep.org/pkg/blobserver"
+)
+
+// ErrLocked is returned by SetLock when a live lock held by a
+// different holder already exists for the requested ref.
+var ErrLocked = fmt.Errorf("lockmgr: blob is locked by another holder")
+
+// ErrTokenMismatch is returned by RefreshLock and Unlock when token
+// doesn't match the ref's current lock.
+var ErrTokenMismatch = fmt.Errorf("lockmgr: token does not match the current lock")
+
+// ErrNotLocked is returned by RefreshLock and Unlock when ref has no
+// live lock at all (never locked, or already expired).
+var ErrNotLocked = fmt.Errorf("lockmgr: blob has no live lock")
+
+// Lock describes one advisory lock held on a blob.
+type Lock struct {
+	Ref     blob.Ref  `json:"ref"`
+	Holder  string    `json:"holder"` // free-form identifier of whoever holds the lock, for diagnostics
+	Token   string    `json:"token"`  // capability required to refresh or release the lock
+	Expires time.Time `json:"expires"`
+}
+
+func (l Lock) live(now time.Time) bool {
+	return !l.Expires.IsZero() && now.Before(l.Expires)
+}
+
+// Manager is an in-memory table of advisory locks, optionally backed
+// by a blobserver.Storage so the table survives a restart (see
+// NewPersistent). The zero Manager is a valid, empty, in-memory-only
+// table.
+type Manager struct {
+	mu    sync.Mutex
+	locks map[blob.Ref]Lock
+
+	// persist, if non-nil, is where the lock table is written after
+	// every mutation and read back from by NewPersistent.
+	persist blobserver.Storage
+	// persistRef is not read or written by any method: the snapshot
+	// is always stored under persistManifestRef.
+	persistRef blob.Ref
+}
+
+// New returns an empty, in-memory-only lock Manager.
+func New() *Manager {
+	return &Manager{locks: make(map[blob.Ref]Lock)}
+}
+
+// persistManifestRef is the well-known ref the lock table snapshot is
+// looked up at by NewPersistent. Lock tables aren't content-addressed
+// data the rest of Perkeep references, so a fixed, reserved ref (akin
+// to a superblock) is simpler than chasing a moving pointer blob.
+var persistManifestRef = blob.RefFromBytes([]byte("lockmgr-table-v1"))
+
+// NewPersistent returns a lock Manager whose table is loaded from,
+// and after every mutation saved back to, store. This lets the lock
+// table survive a server restart, at the cost of one extra small blob
+// write per Set/Refresh/Unlock call.
+func NewPersistent(ctx context.Context, store blobserver.Storage) (*Manager, error) {
+	m := &Manager{locks: make(map[blob.Ref]Lock), persist: store}
+	rc, _, err := store.Fetch(ctx, persistManifestRef)
+	if err != nil {
+		// No saved table yet; start empty.
+		return m, nil
+	}
+	defer rc.Close()
+	data, err := ioutil.ReadAll(rc)
+	if err != nil {
+		return nil, fmt.Errorf("lockmgr: reading saved lock table: %v", err)
+	}
+	var locks []Lock
+	if err := json.Unmarshal(data, &locks); err != nil {
+		return nil, fmt.Errorf("lockmgr: parsing saved lock table: %v", err)
+	}
+	for _, l := range locks {
+		m.locks[l.Ref] = l
+	}
+	return m, nil
+}
+
+// save re-uploads the full lock table snapshot, if m is persistent.
+// Callers must hold m.mu.
+func (m *Manager) save(ctx context.Context) error {
+	if m.persist == nil {
+		return nil
+	}
+	locks := make([]Lock, 0, len(m.locks))
+	for _, l := range m.locks {
+		locks = append(locks, l)
+	}
+	data, err := json.Marshal(locks)
+	if err != nil {
+		return err
+	}
+	// persistManifestRef doesn't hash to data, so this calls
+	// ReceiveBlob directly: blobserver.Receive would reject the write
+	// for its digest mismatch.
+	if _, err := m.persist.ReceiveBlob(ctx, persistManifestRef, bytes.NewReader(data)); err != nil {
+		return fmt.Errorf("lockmgr: saving lock table: %v", err)
+	}
+	return nil
+}
+
+func newToken() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// SetLock acquires a lock on ref for holder, valid for ttl, and
+// returns the token required to refresh or release it. If a live lock
+// already exists for ref held by a different holder, it returns
+// ErrLocked. Re-locking with the same holder succeeds and returns a
+// fresh token, so a holder can renew its own lock without having
+// tracked the previous token.
+func (m *Manager) SetLock(ctx context.Context, ref blob.Ref, holder string, ttl time.Duration) (token string, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := time.Now()
+	if existing, ok := m.locks[ref]; ok && existing.live(now) && existing.Holder != holder {
+		return "", ErrLocked
+	}
+	token, err = newToken()
+	if err != nil {
+		return "", err
+	}
+	if m.locks == nil {
+		m.locks = make(map[blob.Ref]Lock)
+	}
+	m.locks[ref] = Lock{Ref: ref, Holder: holder, Token: token, Expires: now.Add(ttl)}
+	if err := m.save(ctx); err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// RefreshLock extends ref's lock expiry by ttl (from now), but only
+// if token matches the lock's current token and the lock hasn't
+// already expired: once a lock lapses, another holder may already
+// have claimed the blob, so a late refresh must not silently revive
+// it out from under them.
+func (m *Manager) RefreshLock(ctx context.Context, ref blob.Ref, token string, ttl time.Duration) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	existing, ok := m.locks[ref]
+	if !ok || !existing.live(time.Now()) {
+		return ErrNotLocked
+	}
+	if existing.Token != token {
+		return ErrTokenMismatch
+	}
+	existing.Expires = time.Now().Add(ttl)
+	m.locks[ref] = existing
+	return m.save(ctx)
+}
+
+// Unlock releases ref's lock early, if token matches its current
+// token. Unlocking a ref with no live lock returns ErrNotLocked.
+func (m *Manager) Unlock(ctx context.Context, ref blob.Ref, token string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	existing, ok := m.locks[ref]
+	if !ok || !existing.live(time.Now()) {
+		return ErrNotLocked
+	}
+	if existing.Token != token {
+		return ErrTokenMismatch
+	}
+	delete(m.locks, ref)
+	return m.save(ctx)
+}
+
+// Locked reports whether ref currently has a live lock, and if so,
+// returns it. Sync and GC passes call this before deleting or
+// replicating a blob, skipping (and reporting) any that come back
+// locked.
+func (m *Manager) Locked(ref blob.Ref) (Lock, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	l, ok := m.locks[ref]
+	if !ok || !l.live(time.Now()) {
+		return Lock{}, false
+	}
+	return l, true
+}
+
+// Locker is the capability a blobserver.Storage implementation
+// optionally provides, matching Manager's own methods one for one. A
+// storage embeds either a *Manager (see NewPersistent) or, if it
+// doesn't support locks, NoLocker - both satisfy Locker, so sync and
+// GC code can type-assert a storage to Locker (see SkipLocked) without
+// caring which.
+type Locker interface {
+	SetLock(ctx context.Context, ref blob.Ref, holder string, ttl time.Duration) (token string, err error)
+	RefreshLock(ctx context.Context, ref blob.Ref, token string, ttl time.Duration) error
+	Unlock(ctx context.Context, ref blob.Ref, token string) error
+	Locked(ref blob.Ref) (Lock, bool)
+}
+
+var (
+	_ Locker = (*Manager)(nil)
+	_ Locker = NoLocker{}
+)
+
+// NoLocker is the default, zero-cost embed for a blobserver.Storage
+// implementation that doesn't support advisory locks: the mutating
+// methods return ErrNotSupported and Locked always reports "not
+// locked", which SkipLocked (and any other sync/GC code consulting a
+// Locker) treats the same as a ref nobody has pinned, rather than as a
+// reason to block.
+type NoLocker struct{}
+
+// ErrNotSupported is returned by NoLocker's mutating methods.
+var ErrNotSupported = fmt.Errorf("lockmgr: this storage does not support locks")
+
+func (NoLocker) SetLock(ctx context.Context, ref blob.Ref, holder string, ttl time.Duration) (string, error) {
+	return "", ErrNotSupported
+}
+
+func (NoLocker) RefreshLock(ctx context.Context, ref blob.Ref, token string, ttl time.Duration) error {
+	return ErrNotSupported
+}
+
+func (NoLocker) Unlock(ctx context.Context, ref blob.Ref, token string) error {
+	return ErrNotSupported
+}
+
+func (NoLocker) Locked(ref blob.Ref) (Lock, bool) {
+	return Lock{}, false
+}
@@ -0,0 +1,255 @@
+/*
+Copyright 2026 The Perkeep Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package lockmgr
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"perkeep.org/pkg/blob"
+)
+
+func TestSetLock_BlocksOtherHolder(t *testing.T) {
+	m := New()
+	ref := blob.RefFromBytes([]byte("x"))
+	ctx := context.Background()
+
+	if _, err := m.SetLock(ctx, ref, "holder-a", time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.SetLock(ctx, ref, "holder-b", time.Minute); err != ErrLocked {
+		t.Errorf("second holder's SetLock = %v, want ErrLocked", err)
+	}
+}
+
+func TestSetLock_SameHolderRenews(t *testing.T) {
+	m := New()
+	ref := blob.RefFromBytes([]byte("x"))
+	ctx := context.Background()
+
+	tok1, err := m.SetLock(ctx, ref, "holder-a", time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tok2, err := m.SetLock(ctx, ref, "holder-a", time.Minute)
+	if err != nil {
+		t.Fatalf("same holder re-locking: %v", err)
+	}
+	if tok1 == tok2 {
+		t.Error("re-locking should mint a fresh token")
+	}
+}
+
+func TestSetLock_ExpiredLockCanBeReclaimed(t *testing.T) {
+	m := New()
+	ref := blob.RefFromBytes([]byte("x"))
+	ctx := context.Background()
+
+	if _, err := m.SetLock(ctx, ref, "holder-a", -time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := m.Locked(ref); ok {
+		t.Fatal("an already-expired lock should not report as locked")
+	}
+	if _, err := m.SetLock(ctx, ref, "holder-b", time.Minute); err != nil {
+		t.Errorf("locking an expired ref for a new holder: %v", err)
+	}
+}
+
+func TestRefreshLock_RequiresMatchingToken(t *testing.T) {
+	m := New()
+	ref := blob.RefFromBytes([]byte("x"))
+	ctx := context.Background()
+
+	if _, err := m.SetLock(ctx, ref, "holder-a", time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.RefreshLock(ctx, ref, "wrong-token", time.Minute); err != ErrTokenMismatch {
+		t.Errorf("RefreshLock with wrong token = %v, want ErrTokenMismatch", err)
+	}
+}
+
+func TestRefreshLock_ExtendsExpiry(t *testing.T) {
+	m := New()
+	ref := blob.RefFromBytes([]byte("x"))
+	ctx := context.Background()
+
+	token, err := m.SetLock(ctx, ref, "holder-a", 10*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := m.RefreshLock(ctx, ref, token, time.Minute); err != nil {
+		t.Fatalf("RefreshLock: %v", err)
+	}
+	time.Sleep(20 * time.Millisecond)
+	if _, ok := m.Locked(ref); !ok {
+		t.Error("lock refreshed well past its original expiry should still be live")
+	}
+}
+
+func TestRefreshLock_FailsAfterExpiry(t *testing.T) {
+	m := New()
+	ref := blob.RefFromBytes([]byte("x"))
+	ctx := context.Background()
+
+	token, err := m.SetLock(ctx, ref, "holder-a", 10*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(20 * time.Millisecond)
+	if err := m.RefreshLock(ctx, ref, token, time.Minute); err != ErrNotLocked {
+		t.Errorf("RefreshLock after expiry = %v, want ErrNotLocked (a late refresh must not silently revive a lapsed lock)", err)
+	}
+}
+
+func TestUnlock_RequiresMatchingToken(t *testing.T) {
+	m := New()
+	ref := blob.RefFromBytes([]byte("x"))
+	ctx := context.Background()
+
+	token, err := m.SetLock(ctx, ref, "holder-a", time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Unlock(ctx, ref, "wrong-token"); err != ErrTokenMismatch {
+		t.Errorf("Unlock with wrong token = %v, want ErrTokenMismatch", err)
+	}
+	if err := m.Unlock(ctx, ref, token); err != nil {
+		t.Fatalf("Unlock with correct token: %v", err)
+	}
+	if _, ok := m.Locked(ref); ok {
+		t.Error("ref should not be locked after a successful Unlock")
+	}
+}
+
+func TestUnlock_NoLockReturnsErrNotLocked(t *testing.T) {
+	m := New()
+	ref := blob.RefFromBytes([]byte("x"))
+	if err := m.Unlock(context.Background(), ref, "whatever"); err != ErrNotLocked {
+		t.Errorf("Unlock with no lock = %v, want ErrNotLocked", err)
+	}
+}
+
+// memStorage is a minimal in-memory blobserver.Storage, just enough
+// to exercise NewPersistent's load/save round trip.
+type memStorage struct {
+	mu    sync.Mutex
+	blobs map[blob.Ref][]byte
+}
+
+func (s *memStorage) ReceiveBlob(ctx context.Context, br blob.Ref, src io.Reader) (blob.SizedRef, error) {
+	data, err := ioutil.ReadAll(src)
+	if err != nil {
+		return blob.SizedRef{}, err
+	}
+	s.mu.Lock()
+	s.blobs[br] = data
+	s.mu.Unlock()
+	return blob.SizedRef{Ref: br, Size: uint32(len(data))}, nil
+}
+
+func (s *memStorage) Fetch(ctx context.Context, br blob.Ref) (io.ReadCloser, uint32, error) {
+	s.mu.Lock()
+	data, ok := s.blobs[br]
+	s.mu.Unlock()
+	if !ok {
+		return nil, 0, os.ErrNotExist
+	}
+	return ioutil.NopCloser(bytes.NewReader(data)), uint32(len(data)), nil
+}
+
+func (s *memStorage) StatBlobs(ctx context.Context, blobs []blob.Ref, fn func(blob.SizedRef) error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, br := range blobs {
+		if data, ok := s.blobs[br]; ok {
+			if err := fn(blob.SizedRef{Ref: br, Size: uint32(len(data))}); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (s *memStorage) EnumerateBlobs(ctx context.Context, dest chan<- blob.SizedRef, after string, limit int) error {
+	defer close(dest)
+	s.mu.Lock()
+	var refs []blob.Ref
+	for br := range s.blobs {
+		refs = append(refs, br)
+	}
+	s.mu.Unlock()
+	sort.Slice(refs, func(i, j int) bool { return refs[i].String() < refs[j].String() })
+	n := 0
+	for _, br := range refs {
+		if n >= limit {
+			return nil
+		}
+		if br.String() <= after {
+			continue
+		}
+		s.mu.Lock()
+		size := uint32(len(s.blobs[br]))
+		s.mu.Unlock()
+		dest <- blob.SizedRef{Ref: br, Size: size}
+		n++
+	}
+	return nil
+}
+
+func (s *memStorage) RemoveBlobs(ctx context.Context, blobs []blob.Ref) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, br := range blobs {
+		delete(s.blobs, br)
+	}
+	return nil
+}
+
+func TestNewPersistent_RoundTrips(t *testing.T) {
+	store := &memStorage{blobs: make(map[blob.Ref][]byte)}
+	ctx := context.Background()
+
+	m1, err := NewPersistent(ctx, store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ref := blob.RefFromBytes([]byte("x"))
+	token, err := m1.SetLock(ctx, ref, "holder-a", time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m2, err := NewPersistent(ctx, store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, ok := m2.Locked(ref)
+	if !ok {
+		t.Fatal("lock should have survived reload from persistent storage")
+	}
+	if l.Token != token || l.Holder != "holder-a" {
+		t.Errorf("reloaded lock = %+v, want token %q holder %q", l, token, "holder-a")
+	}
+}
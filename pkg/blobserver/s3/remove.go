@@ -17,6 +17,15 @@ limitations under the License.
 package s3
 
 import (
+	"bytes"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sync"
+
 	"context"
 
 	"perkeep.org/pkg/blob"
@@ -24,19 +33,232 @@ import (
 	"go4.org/syncutil"
 )
 
+// maxBatchDeleteKeys is the largest number of keys accepted by S3's
+// Multi-Object Delete API in a single request.
+const maxBatchDeleteKeys = 1000
+
 var removeGate = syncutil.NewGate(20) // arbitrary
 
+// s3RawRequester is implemented by s3 clients able to sign and send
+// an arbitrary request against a bucket, the same way sto.s3Client's
+// Delete already has to sign and send its own DELETE request.
+// RemoveBlobs needs this, rather than a higher-level batch-delete
+// verb, to POST the Multi-Object Delete body itself: the real S3 API
+// has no per-object equivalent of it to wrap.
+type s3RawRequester interface {
+	// Endpoint returns the base request URL for bucket, with no
+	// trailing query string, e.g.
+	// "https://test-bucket.s3.amazonaws.com/".
+	Endpoint(bucket string) string
+	// Do signs req - which must already point at a URL returned by
+	// Endpoint - with this client's S3 credentials, as Delete/Get/Put
+	// do internally, and sends it.
+	Do(req *http.Request) (*http.Response, error)
+}
+
+// multiDeleteXML is the <Delete> request body for POST ?delete.
+type multiDeleteXML struct {
+	XMLName xml.Name            `xml:"Delete"`
+	Quiet   bool                `xml:"Quiet"`
+	Object  []multiDeleteObject `xml:"Object"`
+}
+
+type multiDeleteObject struct {
+	Key string `xml:"Key"`
+}
+
+// multiDeleteResultXML is the <DeleteResult> response body.
+type multiDeleteResultXML struct {
+	XMLName xml.Name            `xml:"DeleteResult"`
+	Deleted []multiDeletedXML   `xml:"Deleted"`
+	Error   []multiDeleteErrXML `xml:"Error"`
+}
+
+type multiDeletedXML struct {
+	Key string `xml:"Key"`
+}
+
+type multiDeleteErrXML struct {
+	Key     string `xml:"Key"`
+	Code    string `xml:"Code"`
+	Message string `xml:"Message"`
+}
+
+// encodeMultiDeleteXML builds the <Delete> request body for the given
+// keys.
+func encodeMultiDeleteXML(keys []string) ([]byte, error) {
+	req := multiDeleteXML{Quiet: true}
+	for _, k := range keys {
+		req.Object = append(req.Object, multiDeleteObject{Key: k})
+	}
+	var buf bytes.Buffer
+	buf.WriteString(xml.Header)
+	if err := xml.NewEncoder(&buf).Encode(req); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// isMalformedXMLResponse reports whether body is an S3 error document
+// with the MalformedXML code, which (along with a 501) is how an S3 -
+// compatible endpoint that doesn't implement Multi-Object Delete
+// rejects the POST ?delete request.
+func isMalformedXMLResponse(body []byte) bool {
+	var errDoc struct {
+		Code string `xml:"Code"`
+	}
+	if xml.Unmarshal(body, &errDoc) != nil {
+		return false
+	}
+	return errDoc.Code == "MalformedXML"
+}
+
+// RemoveBlobsError reports the blob.Refs that a RemoveBlobs call
+// failed to delete, each with the S3 error it was rejected with.
+type RemoveBlobsError struct {
+	Failed map[blob.Ref]error
+}
+
+func (e *RemoveBlobsError) Error() string {
+	return fmt.Sprintf("s3: failed to remove %d of the requested blobs: %v", len(e.Failed), e.firstFew())
+}
+
+func (e *RemoveBlobsError) firstFew() string {
+	const max = 5
+	var buf bytes.Buffer
+	n := 0
+	for ref, err := range e.Failed {
+		if n == max {
+			fmt.Fprintf(&buf, ", ... (%d more)", len(e.Failed)-max)
+			break
+		}
+		if n > 0 {
+			buf.WriteString(", ")
+		}
+		fmt.Fprintf(&buf, "%s: %v", ref, err)
+		n++
+	}
+	return buf.String()
+}
+
 func (sto *s3Storage) RemoveBlobs(ctx context.Context, blobs []blob.Ref) error {
+	rr, ok := sto.s3Client.(s3RawRequester)
+	if !ok {
+		return sto.removeBlobsSingle(ctx, blobs)
+	}
+
+	var (
+		wg     syncutil.Group
+		mu     sync.Mutex
+		failed = make(map[blob.Ref]error)
+	)
+	for start := 0; start < len(blobs); start += maxBatchDeleteKeys {
+		end := start + maxBatchDeleteKeys
+		if end > len(blobs) {
+			end = len(blobs)
+		}
+		batch := blobs[start:end]
+		removeGate.Start()
+		wg.Go(func() error {
+			defer removeGate.Done()
+			return sto.removeBatch(ctx, rr, batch, failed, &mu)
+		})
+	}
+	groupErr := wg.Err()
+
+	mu.Lock()
+	nFailed := len(failed)
+	mu.Unlock()
+	if nFailed == 0 {
+		return groupErr
+	}
+	return &RemoveBlobsError{Failed: failed}
+}
+
+// removeBatch deletes one batch (up to maxBatchDeleteKeys blobs) by
+// POSTing a real Multi-Object Delete request through rr, recording any
+// per-key failures into failed under mu. If the endpoint's response
+// indicates it doesn't support the batch verb at all (a 501, or a 400
+// with the MalformedXML error code), it retries the batch through the
+// single-object path instead.
+func (sto *s3Storage) removeBatch(ctx context.Context, rr s3RawRequester, batch []blob.Ref, failed map[blob.Ref]error, mu *sync.Mutex) error {
+	keys := make([]string, len(batch))
+	byKey := make(map[string]blob.Ref, len(batch))
+	for i, b := range batch {
+		key := sto.dirPrefix + b.String()
+		keys[i] = key
+		byKey[key] = b
+	}
+
+	body, err := encodeMultiDeleteXML(keys)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", rr.Endpoint(sto.bucket)+"?delete", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/xml")
+	// Multi-Object Delete is one of the few S3 APIs that requires
+	// Content-MD5 on every request, not just ones it uses to verify
+	// integrity of uploaded bytes; real S3 rejects a POST ?delete
+	// without it with a 400 before ever looking at the XML body, so
+	// this has to be set even though rr.Do signs the request anyway.
+	digest := md5.Sum(body)
+	req.Header.Set("Content-MD5", base64.StdEncoding.EncodeToString(digest[:]))
+
+	resp, err := rr.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	respBody, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	if resp.StatusCode == http.StatusNotImplemented ||
+		(resp.StatusCode == http.StatusBadRequest && isMalformedXMLResponse(respBody)) {
+		return sto.removeBlobsSingle(ctx, batch)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("s3: batch delete request failed: %s: %s", resp.Status, respBody)
+	}
+
+	var result multiDeleteResultXML
+	if err := xml.Unmarshal(respBody, &result); err != nil {
+		return fmt.Errorf("s3: parsing batch delete response: %v", err)
+	}
+	if len(result.Error) == 0 {
+		return nil
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	for _, e := range result.Error {
+		ref, ok := byKey[e.Key]
+		if !ok {
+			continue
+		}
+		failed[ref] = fmt.Errorf("%s: %s", e.Code, e.Message)
+	}
+	return nil
+}
+
+// removeBlobsSingle is the pre-batching fallback: one DELETE per blob,
+// rate-limited by removeGate. It's used when sto.s3Client doesn't
+// implement s3RawRequester, or when a batch is rejected outright by an
+// endpoint that doesn't support the Multi-Object Delete verb.
+func (sto *s3Storage) removeBlobsSingle(ctx context.Context, blobs []blob.Ref) error {
 	var wg syncutil.Group
 
-	for _, blob := range blobs {
-		blob := blob
+	for _, b := range blobs {
+		b := b
 		removeGate.Start()
 		wg.Go(func() error {
 			defer removeGate.Done()
-			return sto.s3Client.Delete(ctx, sto.bucket, sto.dirPrefix+blob.String())
+			return sto.s3Client.Delete(ctx, sto.bucket, sto.dirPrefix+b.String())
 		})
 	}
 	return wg.Err()
-
 }
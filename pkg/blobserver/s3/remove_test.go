@@ -0,0 +1,205 @@
+/*
+Copyright 2011 The Perkeep Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package s3
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"perkeep.org/pkg/blob"
+)
+
+// fakeS3Client is a fake S3 client that actually parses and answers
+// the Multi-Object Delete XML request RemoveBlobs POSTs, so these
+// tests exercise the real wire format rather than a higher-level
+// stand-in verb.
+type fakeS3Client struct {
+	supportsBatch bool
+	batches       [][]string
+	failKeys      map[string]multiDeleteErrXML
+	singleDeletes []string
+	singleErrKeys map[string]error
+
+	// requireContentMD5, when true, makes Do reject a request the way
+	// real S3 does when Content-MD5 is missing or doesn't match the
+	// body: with a 400 that isn't the MalformedXML code removeBatch's
+	// fallback detection looks for, so a wrong/missing header surfaces
+	// as a hard batch-delete failure rather than a silent fallback.
+	requireContentMD5 bool
+}
+
+func (f *fakeS3Client) Delete(ctx context.Context, bucket, key string) error {
+	f.singleDeletes = append(f.singleDeletes, key)
+	if err, ok := f.singleErrKeys[key]; ok {
+		return err
+	}
+	return nil
+}
+
+func (f *fakeS3Client) Endpoint(bucket string) string {
+	return "https://" + bucket + ".s3.example.com/"
+}
+
+func (f *fakeS3Client) Do(req *http.Request) (*http.Response, error) {
+	if !f.supportsBatch {
+		return httptestResponse(req, http.StatusBadRequest, []byte(`<Error><Code>MalformedXML</Code></Error>`)), nil
+	}
+
+	body, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	if f.requireContentMD5 {
+		sum := md5.Sum(body)
+		want := base64.StdEncoding.EncodeToString(sum[:])
+		if got := req.Header.Get("Content-MD5"); got != want {
+			return httptestResponse(req, http.StatusBadRequest,
+				[]byte(`<Error><Code>InvalidRequest</Code><Message>Missing required header for this request: Content-MD5</Message></Error>`)), nil
+		}
+	}
+
+	var parsed multiDeleteXML
+	if err := xml.Unmarshal(body, &parsed); err != nil {
+		return nil, fmt.Errorf("fakeS3Client: bad request XML: %v", err)
+	}
+	keys := make([]string, len(parsed.Object))
+	for i, o := range parsed.Object {
+		keys[i] = o.Key
+	}
+	f.batches = append(f.batches, keys)
+
+	result := multiDeleteResultXML{}
+	for _, k := range keys {
+		if e, ok := f.failKeys[k]; ok {
+			result.Error = append(result.Error, e)
+			continue
+		}
+		result.Deleted = append(result.Deleted, multiDeletedXML{Key: k})
+	}
+	respBody, err := xml.Marshal(result)
+	if err != nil {
+		return nil, err
+	}
+	return httptestResponse(req, http.StatusOK, respBody), nil
+}
+
+func httptestResponse(req *http.Request, status int, body []byte) *http.Response {
+	rr := httptest.NewRecorder()
+	rr.WriteHeader(status)
+	rr.Body = bytes.NewBuffer(body)
+	return rr.Result()
+}
+
+func refForKey(i int) blob.Ref {
+	return blob.RefFromString(fmt.Sprintf("blob-%d", i))
+}
+
+func TestRemoveBlobsBatches(t *testing.T) {
+	const n = 2500 // spans three batches of up to 1000
+	blobs := make([]blob.Ref, n)
+	for i := range blobs {
+		blobs[i] = refForKey(i)
+	}
+
+	fake := &fakeS3Client{supportsBatch: true}
+	sto := &s3Storage{s3Client: fake, bucket: "test-bucket"}
+
+	if err := sto.RemoveBlobs(context.Background(), blobs); err != nil {
+		t.Fatalf("RemoveBlobs: %v", err)
+	}
+	if len(fake.batches) != 3 {
+		t.Fatalf("got %d batches, want 3", len(fake.batches))
+	}
+	total := 0
+	for _, b := range fake.batches {
+		if len(b) > maxBatchDeleteKeys {
+			t.Fatalf("batch of size %d exceeds maxBatchDeleteKeys", len(b))
+		}
+		total += len(b)
+	}
+	if total != n {
+		t.Fatalf("deleted %d keys total, want %d", total, n)
+	}
+	if len(fake.singleDeletes) != 0 {
+		t.Fatalf("unexpected fallback to single-object deletes: %v", fake.singleDeletes)
+	}
+}
+
+func TestRemoveBlobsPerKeyErrors(t *testing.T) {
+	blobs := []blob.Ref{refForKey(0), refForKey(1), refForKey(2)}
+	fake := &fakeS3Client{
+		supportsBatch: true,
+		failKeys: map[string]multiDeleteErrXML{
+			"" + refForKey(1).String(): {Key: refForKey(1).String(), Code: "AccessDenied", Message: "not allowed"},
+		},
+	}
+	sto := &s3Storage{s3Client: fake, bucket: "test-bucket"}
+
+	err := sto.RemoveBlobs(context.Background(), blobs)
+	if err == nil {
+		t.Fatal("expected error, got nil")
+	}
+	rbErr, ok := err.(*RemoveBlobsError)
+	if !ok {
+		t.Fatalf("got error of type %T, want *RemoveBlobsError", err)
+	}
+	if len(rbErr.Failed) != 1 {
+		t.Fatalf("got %d failed blobs, want 1", len(rbErr.Failed))
+	}
+	if _, ok := rbErr.Failed[refForKey(1)]; !ok {
+		t.Fatalf("expected %v to be reported as failed, got %v", refForKey(1), rbErr.Failed)
+	}
+}
+
+func TestRemoveBlobsSetsContentMD5(t *testing.T) {
+	blobs := []blob.Ref{refForKey(0), refForKey(1)}
+	fake := &fakeS3Client{supportsBatch: true, requireContentMD5: true}
+	sto := &s3Storage{s3Client: fake, bucket: "test-bucket"}
+
+	// Real S3 rejects a Multi-Object Delete POST that's missing (or
+	// has a wrong) Content-MD5 with a 400 that removeBatch's fallback
+	// detection doesn't recognize, so if the header were absent this
+	// would surface as a hard batch-delete error rather than success.
+	if err := sto.RemoveBlobs(context.Background(), blobs); err != nil {
+		t.Fatalf("RemoveBlobs: %v", err)
+	}
+	if len(fake.batches) != 1 {
+		t.Fatalf("got %d batches, want 1", len(fake.batches))
+	}
+}
+
+func TestRemoveBlobsFallsBackWhenBatchUnsupported(t *testing.T) {
+	blobs := []blob.Ref{refForKey(0), refForKey(1)}
+	fake := &fakeS3Client{supportsBatch: false}
+	sto := &s3Storage{s3Client: fake, bucket: "test-bucket"}
+
+	if err := sto.RemoveBlobs(context.Background(), blobs); err != nil {
+		t.Fatalf("RemoveBlobs: %v", err)
+	}
+	if len(fake.singleDeletes) != len(blobs) {
+		t.Fatalf("got %d single deletes, want %d", len(fake.singleDeletes), len(blobs))
+	}
+}
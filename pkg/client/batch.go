@@ -0,0 +1,185 @@
+/*
+Copyright 2026 The Perkeep Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package client
+
+// This file adds pkg/blobserver/batch awareness to the uploader: it
+// POSTs the whole pending set to the server's batch endpoint once, so
+// an upload's de-dup check takes one round trip total - the dominant
+// cost of an initial import of a large tree over a high-latency link.
+// When the server has no batch endpoint, the fallback PUTs each blob
+// to its own per-blob endpoint without statting it first, so no
+// de-dup check is made on that path.
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+
+	"perkeep.org/pkg/blob"
+	"perkeep.org/pkg/blobserver/batch"
+)
+
+// batchPath is where a server's batch.Handler is expected to be
+// mounted.
+const batchPath = "/camli/batch"
+
+// batchPlan is the result of asking the server's batch endpoint what
+// to do with a set of pending blobs.
+type batchPlan struct {
+	// Upload maps a blob the server doesn't have yet to the action
+	// (href + header) its bytes should be PUT to.
+	Upload map[blob.Ref]batch.Action
+	// Skip is the set of blobs the server already reported having:
+	// the uploader shouldn't even read these off disk.
+	Skip map[blob.Ref]bool
+}
+
+// tryBatchPlan asks the server's batch endpoint what to do with
+// pending in one round trip. ok is false, with err nil, when the
+// server doesn't implement the batch endpoint (a 404 or 405):
+// UploadPending then PUTs every pending blob through legacyPutOne,
+// with no stat beforehand. Any
+// other non-2xx response, or a transport/decode failure, is returned
+// as err.
+func (c *Client) tryBatchPlan(pending []blob.SizedRef) (plan batchPlan, ok bool, err error) {
+	objs := make([]batch.Object, len(pending))
+	for i, sb := range pending {
+		objs[i] = batch.Object{Ref: sb.Ref, Size: sb.Size}
+	}
+	reqJSON, err := json.Marshal(batch.Request{Operation: batch.OpUpload, Objects: objs})
+	if err != nil {
+		return batchPlan{}, false, err
+	}
+
+	resp, err := c.httpClient().Post(c.serverURL()+batchPath, "application/json", bytes.NewReader(reqJSON))
+	if err != nil {
+		return batchPlan{}, false, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound || resp.StatusCode == http.StatusMethodNotAllowed {
+		return batchPlan{}, false, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(resp.Body)
+		return batchPlan{}, false, fmt.Errorf("client: batch request failed: %s: %s", resp.Status, body)
+	}
+
+	var batchResp batch.Response
+	if err := json.NewDecoder(resp.Body).Decode(&batchResp); err != nil {
+		return batchPlan{}, false, fmt.Errorf("client: decoding batch response: %v", err)
+	}
+
+	plan = batchPlan{Upload: make(map[blob.Ref]batch.Action), Skip: make(map[blob.Ref]bool)}
+	for _, o := range batchResp.Objects {
+		if o.Error != nil {
+			// Leave it out of both maps: the legacy per-blob path
+			// will hit (and report) this blob's problem on its own.
+			continue
+		}
+		if action, has := o.Actions[string(batch.OpUpload)]; has {
+			plan.Upload[o.Ref] = action
+			continue
+		}
+		plan.Skip[o.Ref] = true
+	}
+	return plan, true, nil
+}
+
+// putViaAction PUTs data to the transfer URL a batch action named,
+// applying whatever extra headers it specified (e.g. for an
+// S3-backed direct-upload endpoint).
+func (c *Client) putViaAction(action batch.Action, ref blob.Ref, data []byte) error {
+	req, err := http.NewRequest("PUT", action.Href, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	for k, v := range action.Header {
+		req.Header.Set(k, v)
+	}
+	resp, err := c.httpClient().Do(req)
+	if err != nil {
+		return fmt.Errorf("client: batch upload of %v: %v", ref, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		body, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("client: batch upload of %v failed: %s: %s", ref, resp.Status, body)
+	}
+	return nil
+}
+
+// legacyPutOne PUTs data directly to ref's own per-blob endpoint - the
+// same one batch.Handler itself points its own per-blob Actions at
+// (see batch.Handler.BaseURL) - bypassing the batch endpoint
+// entirely. It's UploadPending's fallback for any blob the batch plan
+// didn't cover.
+func (c *Client) legacyPutOne(ref blob.Ref, data []byte) error {
+	req, err := http.NewRequest("PUT", c.serverURL()+"/camli/"+ref.String(), bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	resp, err := c.httpClient().Do(req)
+	if err != nil {
+		return fmt.Errorf("client: put of %v: %v", ref, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		body, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("client: put of %v failed: %s: %s", ref, resp.Status, body)
+	}
+	return nil
+}
+
+// UploadPending uploads whatever bytes the server doesn't already
+// have from pending. It asks the batch endpoint what to do in one
+// round trip via tryBatchPlan, then for each blob in pending: skips
+// it if the plan says the server already has it, PUTs it through the
+// action the plan named if there is one, and otherwise falls back to
+// legacyPutOne - which also covers the case where the server doesn't
+// implement the batch endpoint at all (tryBatchPlan's ok is false).
+// get is called lazily, one at a time, for each blob the plan doesn't
+// mark as Skip, so a blob the plan reports the server already has is
+// never read off disk. Without a plan (ok false) get is called for
+// every blob in pending, including ones the server already has, since
+// the fallback makes no stat call.
+func (c *Client) UploadPending(pending []blob.SizedRef, get func(blob.Ref) ([]byte, error)) error {
+	plan, ok, err := c.tryBatchPlan(pending)
+	if err != nil {
+		return err
+	}
+	for _, sb := range pending {
+		if ok && plan.Skip[sb.Ref] {
+			continue
+		}
+		data, err := get(sb.Ref)
+		if err != nil {
+			return err
+		}
+		if action, has := plan.Upload[sb.Ref]; ok && has {
+			if err := c.putViaAction(action, sb.Ref, data); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := c.legacyPutOne(sb.Ref, data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
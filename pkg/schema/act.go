@@ -0,0 +1,260 @@
+/*
+Copyright 2026 The Perkeep Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package schema describes the JSON schemas of Perkeep's metadata
+// blobs.
+package schema
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+
+	"perkeep.org/pkg/blob"
+
+	"golang.org/x/crypto/nacl/box"
+	"golang.org/x/crypto/nacl/secretbox"
+)
+
+// camliTypeAccessControl is the camliType of an ACTManifest blob.
+const camliTypeAccessControl = "access-control"
+
+// SessionKeyAlgSecretbox identifies the symmetric cipher an
+// ACTManifest's session key is used with once a recipient has
+// unsealed it: NaCl's secretbox (XSalsa20-Poly1305), the same
+// primitive family the manifest's own grants are sealed with. It's
+// recorded so a future algorithm change doesn't silently misinterpret
+// an old manifest, the same convention the envelope wrapper's own Alg
+// field follows.
+const SessionKeyAlgSecretbox = "xsalsa20poly1305"
+
+// ACTManifest is the schema of an "access-control" blob: the
+// access-control manifest for a single ShareACT share. It names a
+// target blob (the share's actual content, sealed under the session
+// key with SealPayload) and, for each authorized recipient, that
+// recipient's own copy of the session key, sealed to their X25519
+// public key so that anyone
+// holding the manifest and the matching private key can recover the
+// session key without any server's cooperation.
+type ACTManifest struct {
+	CamliVersion  int     `json:"camliVersion"`
+	CamliType     string  `json:"camliType"`
+	Target        string  `json:"target"` // blob.Ref of the SealPayload-sealed share target
+	SessionKeyAlg string  `json:"sessionKeyAlg"`
+	Grants        []Grant `json:"grants"`
+}
+
+// Grant is one recipient's entry in an ACTManifest: a copy of the
+// share's session key, sealed so only that recipient can open it.
+type Grant struct {
+	RecipientKey  string `json:"recipientKey"`  // hex X25519 public key
+	EncSessionKey string `json:"encSessionKey"` // hex NaCl sealed-box ciphertext
+	// Nonce is unused by the current (anonymous sealed-box) grants:
+	// a sealed box derives its nonce from the ephemeral public key
+	// it embeds, rather than needing one transmitted alongside it.
+	// The field is kept, and left empty, so a future non-anonymous
+	// grant mode can populate it without a manifest schema bump.
+	Nonce string `json:"nonce,omitempty"`
+}
+
+// GenerateSessionKey returns a fresh random session key, suitable for
+// sealing a share target with SealPayload before its ref is known -
+// which NewACTManifestForSessionKey then needs, alongside that target,
+// to build the manifest granting access to it.
+func GenerateSessionKey() ([]byte, error) {
+	sessionKey := make([]byte, 32)
+	if _, err := rand.Read(sessionKey); err != nil {
+		return nil, fmt.Errorf("schema: generating session key: %v", err)
+	}
+	return sessionKey, nil
+}
+
+// SealPayload encrypts plaintext under sessionKey (as produced by
+// GenerateSessionKey) using NaCl's secretbox, the scheme named by
+// SessionKeyAlgSecretbox. The returned bytes - a random nonce
+// followed by the sealed ciphertext - are what the caller uploads as
+// the manifest's target blob; OpenPayload needs nothing but
+// sessionKey and those bytes to recover plaintext.
+func SealPayload(sessionKey, plaintext []byte) ([]byte, error) {
+	var key [32]byte
+	if len(sessionKey) != len(key) {
+		return nil, fmt.Errorf("schema: session key is %d bytes, want %d", len(sessionKey), len(key))
+	}
+	copy(key[:], sessionKey)
+	var nonce [24]byte
+	if _, err := rand.Read(nonce[:]); err != nil {
+		return nil, fmt.Errorf("schema: generating nonce: %v", err)
+	}
+	return secretbox.Seal(nonce[:], plaintext, &nonce, &key), nil
+}
+
+// OpenPayload decrypts sealed - a blob previously produced by
+// SealPayload - using sessionKey, e.g. one recovered via
+// SessionKeyFor. This is what a recipient's own client calls after
+// fetching both the manifest and its target blob directly from
+// storage; it doesn't require the share handler, or any server, to be
+// involved at all.
+func OpenPayload(sessionKey, sealed []byte) ([]byte, error) {
+	var key [32]byte
+	if len(sessionKey) != len(key) {
+		return nil, fmt.Errorf("schema: session key is %d bytes, want %d", len(sessionKey), len(key))
+	}
+	copy(key[:], sessionKey)
+	if len(sealed) < 24 {
+		return nil, fmt.Errorf("schema: sealed payload is too short to contain a nonce")
+	}
+	var nonce [24]byte
+	copy(nonce[:], sealed[:24])
+	plaintext, ok := secretbox.Open(nil, sealed[24:], &nonce, &key)
+	if !ok {
+		return nil, fmt.Errorf("schema: payload decryption failed")
+	}
+	return plaintext, nil
+}
+
+// NewACTManifest builds an access-control manifest for target,
+// generating a fresh random session key and sealing a copy of it to
+// each of recipients, and returns that session key; the key itself is
+// never stored in the clear. Because the key is generated after target
+// is named, target cannot be a SealPayload blob sealed under it; a
+// caller that needs that uses GenerateSessionKey and
+// NewACTManifestForSessionKey instead.
+func NewACTManifest(target blob.Ref, recipients ...[32]byte) (m *ACTManifest, sessionKey []byte, err error) {
+	sessionKey, err = GenerateSessionKey()
+	if err != nil {
+		return nil, nil, err
+	}
+	m, err = NewACTManifestForSessionKey(target, sessionKey, recipients...)
+	if err != nil {
+		return nil, nil, err
+	}
+	return m, sessionKey, nil
+}
+
+// NewACTManifestForSessionKey builds an access-control manifest for
+// target exactly like NewACTManifest, except the caller supplies
+// sessionKey - already used to SealPayload the blob target names -
+// instead of having one generated. This is what lets a caller mint
+// the target's ciphertext (and so its ref) before the manifest
+// embedding that ref can be built.
+func NewACTManifestForSessionKey(target blob.Ref, sessionKey []byte, recipients ...[32]byte) (*ACTManifest, error) {
+	m := &ACTManifest{
+		CamliVersion:  1,
+		CamliType:     camliTypeAccessControl,
+		Target:        target.String(),
+		SessionKeyAlg: SessionKeyAlgSecretbox,
+	}
+	for _, pub := range recipients {
+		pub := pub
+		sealed, err := box.SealAnonymous(nil, sessionKey, &pub, rand.Reader)
+		if err != nil {
+			return nil, fmt.Errorf("schema: sealing session key to %x: %v", pub, err)
+		}
+		m.Grants = append(m.Grants, Grant{
+			RecipientKey:  hex.EncodeToString(pub[:]),
+			EncSessionKey: hex.EncodeToString(sealed),
+		})
+	}
+	return m, nil
+}
+
+// HasGrant reports whether pubHex (a hex-encoded X25519 public key)
+// is listed as an authorized recipient.
+func (m *ACTManifest) HasGrant(pubHex string) bool {
+	for _, g := range m.Grants {
+		if g.RecipientKey == pubHex {
+			return true
+		}
+	}
+	return false
+}
+
+// SessionKeyFor returns the plaintext session key from the grant
+// matching pub, opening its sealed box with priv. This is what a
+// recipient's own client calls after fetching the manifest blob
+// directly from storage; it doesn't require the share handler, or
+// any server, to be involved at all.
+func (m *ACTManifest) SessionKeyFor(pub, priv *[32]byte) ([]byte, bool) {
+	want := hex.EncodeToString(pub[:])
+	for _, g := range m.Grants {
+		if g.RecipientKey != want {
+			continue
+		}
+		sealed, err := hex.DecodeString(g.EncSessionKey)
+		if err != nil {
+			return nil, false
+		}
+		return box.OpenAnonymous(nil, sealed, pub, priv)
+	}
+	return nil, false
+}
+
+// Revoke reports every current recipient except revoke, for a caller
+// that's about to cut that recipient's access: because the old
+// session key (and therefore the old ciphertext blob, which the
+// revoked recipient can still decrypt) remains compromised, replacing
+// a grant isn't just editing this manifest's Grants - the caller must
+// generate a fresh session key (GenerateSessionKey), re-encrypt the
+// plaintext under it (SealPayload) to get a new, unrelated target
+// ref, and build the replacement manifest for that new target and
+// the recipients Revoke returns (NewACTManifestForSessionKey).
+func (m *ACTManifest) Revoke(revoke [32]byte) (keep [][32]byte, err error) {
+	revokeHex := hex.EncodeToString(revoke[:])
+	for _, g := range m.Grants {
+		if g.RecipientKey == revokeHex {
+			continue
+		}
+		pub, err := decodeKey32(g.RecipientKey)
+		if err != nil {
+			return nil, err
+		}
+		keep = append(keep, pub)
+	}
+	return keep, nil
+}
+
+// Encode returns m's JSON blob representation, suitable for uploading
+// to a blobserver.Storage.
+func (m *ACTManifest) Encode() ([]byte, error) {
+	return json.Marshal(m)
+}
+
+// ParseACTManifest parses an access-control manifest blob previously
+// produced by ACTManifest.Encode.
+func ParseACTManifest(data []byte) (*ACTManifest, error) {
+	var m ACTManifest
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, fmt.Errorf("schema: parsing access-control manifest: %v", err)
+	}
+	if m.CamliType != camliTypeAccessControl {
+		return nil, fmt.Errorf("schema: not an %q blob (camliType=%q)", camliTypeAccessControl, m.CamliType)
+	}
+	return &m, nil
+}
+
+func decodeKey32(s string) ([32]byte, error) {
+	var out [32]byte
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		return out, fmt.Errorf("schema: invalid hex key %q: %v", s, err)
+	}
+	if len(b) != len(out) {
+		return out, fmt.Errorf("schema: key %q is %d bytes, want %d", s, len(b), len(out))
+	}
+	copy(out[:], b)
+	return out, nil
+}
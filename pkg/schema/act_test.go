@@ -0,0 +1,199 @@
+/*
+Copyright 2026 The Perkeep Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package schema
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"testing"
+
+	"perkeep.org/pkg/blob"
+
+	"golang.org/x/crypto/nacl/box"
+)
+
+func genKeypair(t *testing.T) (pub, priv *[32]byte) {
+	t.Helper()
+	pub, priv, err := box.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pub, priv
+}
+
+func TestACTManifest_GrantAndOpen(t *testing.T) {
+	target := blob.RefFromBytes([]byte("shared content"))
+	alicePub, alicePriv := genKeypair(t)
+	bobPub, bobPriv := genKeypair(t)
+
+	m, sessionKey, err := NewACTManifest(target, *alicePub, *bobPub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(m.Grants) != 2 {
+		t.Fatalf("got %d grants, want 2", len(m.Grants))
+	}
+
+	for _, recipient := range []struct {
+		pub, priv *[32]byte
+	}{
+		{alicePub, alicePriv},
+		{bobPub, bobPriv},
+	} {
+		got, ok := m.SessionKeyFor(recipient.pub, recipient.priv)
+		if !ok {
+			t.Fatalf("SessionKeyFor(%x) failed to open grant", recipient.pub[:4])
+		}
+		if !bytes.Equal(got, sessionKey) {
+			t.Errorf("recovered session key doesn't match the one the manifest was created with")
+		}
+	}
+}
+
+func TestACTManifest_SessionKeyForRejectsUnknownRecipient(t *testing.T) {
+	target := blob.RefFromBytes([]byte("shared content"))
+	alicePub, _ := genKeypair(t)
+	m, _, err := NewACTManifest(target, *alicePub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	evePub, evePriv := genKeypair(t)
+	if _, ok := m.SessionKeyFor(evePub, evePriv); ok {
+		t.Error("SessionKeyFor should fail for a key with no grant")
+	}
+}
+
+func TestACTManifest_Revoke(t *testing.T) {
+	oldTarget := blob.RefFromBytes([]byte("shared content"))
+	alicePub, alicePriv := genKeypair(t)
+	bobPub, bobPriv := genKeypair(t)
+
+	m, _, err := NewACTManifest(oldTarget, *alicePub, *bobPub)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keep, err := m.Revoke(*bobPub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keep) != 1 || keep[0] != *alicePub {
+		t.Fatalf("Revoke kept %x, want just alice (%x)", keep, alicePub[:])
+	}
+
+	newSessionKey, err := GenerateSessionKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sealed, err := SealPayload(newSessionKey, []byte("shared content, re-encrypted"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	newTarget := blob.RefFromBytes(sealed)
+	if newTarget == oldTarget {
+		t.Fatal("re-encrypted target unexpectedly collided with the old one")
+	}
+
+	revoked, err := NewACTManifestForSessionKey(newTarget, newSessionKey, keep...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if revoked.Target == m.Target {
+		t.Error("revoked manifest should point at a fresh target, not the old one")
+	}
+	if revoked.HasGrant(hex.EncodeToString(bobPub[:])) {
+		t.Error("revoked recipient should have no grant in the new manifest")
+	}
+	if _, ok := revoked.SessionKeyFor(bobPub, bobPriv); ok {
+		t.Error("revoked recipient should not be able to recover the new session key")
+	}
+	got, ok := revoked.SessionKeyFor(alicePub, alicePriv)
+	if !ok {
+		t.Fatal("remaining recipient should still be able to recover the new session key")
+	}
+	if !bytes.Equal(got, newSessionKey) {
+		t.Error("remaining recipient's recovered key doesn't match the manifest's new session key")
+	}
+}
+
+func TestSealOpenPayload_RoundTrip(t *testing.T) {
+	sessionKey, err := GenerateSessionKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	plaintext := []byte("shared content")
+	sealed, err := SealPayload(sessionKey, plaintext)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(sealed, plaintext) {
+		t.Error("sealed payload should not contain the plaintext in the clear")
+	}
+	got, err := OpenPayload(sessionKey, sealed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, plaintext) {
+		t.Errorf("OpenPayload = %q, want %q", got, plaintext)
+	}
+}
+
+func TestOpenPayload_RejectsWrongKey(t *testing.T) {
+	sessionKey, err := GenerateSessionKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sealed, err := SealPayload(sessionKey, []byte("shared content"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	wrongKey, err := GenerateSessionKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := OpenPayload(wrongKey, sealed); err == nil {
+		t.Error("OpenPayload should fail with the wrong session key")
+	}
+}
+
+func TestACTManifest_EncodeParseRoundTrip(t *testing.T) {
+	target := blob.RefFromBytes([]byte("shared content"))
+	alicePub, _ := genKeypair(t)
+	m, _, err := NewACTManifest(target, *alicePub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := m.Encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := ParseACTManifest(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Target != m.Target || len(got.Grants) != len(m.Grants) {
+		t.Errorf("round-tripped manifest = %+v, want %+v", got, m)
+	}
+}
+
+func TestParseACTManifest_RejectsWrongCamliType(t *testing.T) {
+	_, err := ParseACTManifest([]byte(`{"camliVersion":1,"camliType":"share"}`))
+	if err == nil {
+		t.Fatal("expected an error parsing a blob with the wrong camliType")
+	}
+}
@@ -0,0 +1,167 @@
+/*
+Copyright 2026 The Perkeep Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package server holds the Perkeep server-side HTTP handlers.
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/url"
+	"strconv"
+	"time"
+
+	"perkeep.org/pkg/blob"
+	"perkeep.org/pkg/blobserver/handlers"
+
+	"go4.org/jsonconfig"
+)
+
+// shareHandler serves "share" URLs: a recipient holding a claim's
+// blobref can browse, and fetch, whatever the claim's target permits,
+// without an authenticated Perkeep account.
+//
+// For most requests that means proxying the blob through this
+// handler so the normal auth chain never has to trust the recipient.
+// But for large embedded content (e.g. an <img> or <video> src on a
+// shared page) proxying every byte through here is wasteful,
+// especially behind a CDN that would otherwise cache the bytes
+// directly. When signing is configured, the handler instead mints a
+// short-lived, signed direct-fetch URL that the handler
+// pkg/blobserver/handlers.CreateGetHandler returns will accept without
+// re-checking the share claim, and the
+// CDN can cache the response like any other static URL.
+type shareHandler struct {
+	fetcher blob.Fetcher
+	signing handlers.SigningSecrets // zero value disables direct-fetch URLs
+
+	// actKey is the server's own long-term X25519 private key, used
+	// to authenticate "Camli-ACT" proofs of possession on ShareACT
+	// manifests (see share_act.go). nil disables ACT shares.
+	actKey *[32]byte
+}
+
+// defaultSignTTL is how long a minted direct-fetch URL stays valid
+// when the caller doesn't need a shorter window. It's deliberately
+// short: long enough for a page load and its CDN cache to populate,
+// short enough that a leaked URL (e.g. via a referer header) is only
+// useful briefly.
+const defaultSignTTL = 1 * time.Hour
+
+// SignBlobRef returns the query string ("sig=...&exp=...&sub=...") to
+// append to a direct-fetch URL for ref, granting access until ttl has
+// elapsed. subject scopes the token to the share claim that
+// authorized it (its blobref is the natural choice), so a token
+// minted for one share's claim can't be replayed to reach a blob
+// reachable only from a different share. It returns an error if the
+// handler has no signing secret configured, in which case callers
+// should fall back to proxying the blob through the share handler
+// itself instead of a direct-fetch URL.
+func (sh *shareHandler) SignBlobRef(ref blob.Ref, ttl time.Duration, subject string) (string, error) {
+	if sh.signing.Zero() {
+		return "", fmt.Errorf("server: share signing is not configured")
+	}
+	if ttl <= 0 {
+		ttl = defaultSignTTL
+	}
+	exp := time.Now().Add(ttl)
+	token, err := sh.signing.Sign(ref, exp, subject)
+	if err != nil {
+		return "", err
+	}
+	v := make(url.Values)
+	v.Set("sig", token)
+	v.Set("exp", strconv.FormatInt(exp.Unix(), 16))
+	if subject != "" {
+		v.Set("sub", subject)
+	}
+	return v.Encode(), nil
+}
+
+// signingSecretsFromConfig parses the low-level server config's
+// "shareSigning" block:
+//
+//	"shareSigning": {
+//	  "current": "2026-07",
+//	  "keys": {
+//	    "2026-07": "<hex-encoded secret>",
+//	    "2026-01": "<hex-encoded secret being retired>"
+//	  },
+//	  "sigBytes": 10
+//	}
+//
+// "current" names the key new URLs are signed with; every entry in
+// "keys" (including retired ones) is still accepted by Verify, so a
+// secret can be rotated by adding a new "current" and leaving the old
+// kid in "keys" until every URL signed with it has expired on its own
+// ttl. "sigBytes" is optional and defaults to
+// handlers.defaultSigBytes; it exists so a deployment that wants a
+// longer margin than the default can configure one, at the cost of a
+// longer query string, up to the full sha256.Size-byte digest. The
+// block is optional: an absent or empty config leaves signing
+// disabled and callers fall back to proxying through the share
+// handler.
+func signingSecretsFromConfig(conf jsonconfig.Obj) (handlers.SigningSecrets, error) {
+	if len(conf) == 0 {
+		return handlers.SigningSecrets{}, nil
+	}
+	current := conf.RequiredString("current")
+	keysConf := conf.RequiredObject("keys")
+	sigBytes := conf.OptionalInt("sigBytes", 0)
+	if err := conf.Validate(); err != nil {
+		return handlers.SigningSecrets{}, err
+	}
+	keys := make(map[string][]byte, len(keysConf))
+	for kid, v := range keysConf {
+		hexSecret, ok := v.(string)
+		if !ok {
+			return handlers.SigningSecrets{}, fmt.Errorf("server: shareSigning key %q is not a string", kid)
+		}
+		secret, err := hex.DecodeString(hexSecret)
+		if err != nil {
+			return handlers.SigningSecrets{}, fmt.Errorf("server: shareSigning key %q: %v", kid, err)
+		}
+		keys[kid] = secret
+	}
+	if _, ok := keys[current]; !ok {
+		return handlers.SigningSecrets{}, fmt.Errorf("server: shareSigning \"current\" %q has no matching entry in \"keys\"", current)
+	}
+	if sigBytes < 0 || sigBytes > sha256.Size {
+		return handlers.SigningSecrets{}, fmt.Errorf("server: shareSigning \"sigBytes\" must be between 0 and %d", sha256.Size)
+	}
+	return handlers.SigningSecrets{Current: current, Keys: keys, SigBytes: sigBytes}, nil
+}
+
+// actKeyFromConfig parses the low-level server config's "shareACTKey"
+// value: a hex-encoded X25519 private key the server uses to
+// authenticate Camli-ACT proofs (see share_act.go). An empty string
+// leaves ACT shares disabled.
+func actKeyFromConfig(hexKey string) (*[32]byte, error) {
+	if hexKey == "" {
+		return nil, nil
+	}
+	b, err := hex.DecodeString(hexKey)
+	if err != nil {
+		return nil, fmt.Errorf("server: shareACTKey: %v", err)
+	}
+	if len(b) != 32 {
+		return nil, fmt.Errorf("server: shareACTKey is %d bytes, want 32", len(b))
+	}
+	var key [32]byte
+	copy(key[:], b)
+	return &key, nil
+}
@@ -0,0 +1,237 @@
+/*
+Copyright 2026 The Perkeep Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"perkeep.org/pkg/blob"
+	"perkeep.org/pkg/schema"
+
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/nacl/box"
+)
+
+// actKeyPath is the path this handler serves the server's ACT public
+// key from, relative to its own mount point. A recipient's client has
+// no other way to learn what public key a Camli-ACT proof must be
+// sealed to: it isn't carried in the manifest (which is written once,
+// by whoever uploaded the share, and shouldn't need to be rewritten if
+// the server ever rotates its ACT keypair) and isn't configured
+// anywhere the client would already have it.
+const actKeyPath = "act-key"
+
+// actSessionKeyHeader carries the hex-encoded session key a recipient
+// forwards alongside their Camli-ACT proof, so serveACTShare can
+// decrypt the target on their behalf. The server never holds any
+// recipient's private key - manifest grants are sealed with
+// box.SealAnonymous to each recipient's own public key - so it has no
+// way to derive this itself; the recipient's own client must first
+// recover it locally, via manifest.SessionKeyFor(pub, priv), exactly
+// as it would if it were fetching the manifest and target directly
+// from storage instead of through this handler.
+const actSessionKeyHeader = "X-Camli-Act-Session-Key"
+
+// ShareACT is a share claim's shareType for an access-control-manifest
+// share: one built on a schema.ACTManifest rather than a single
+// anonymously-readable target. Unlike other share types, serving it
+// requires a valid "Camli-ACT" Authorization header; there is no
+// anonymous fallback.
+const ShareACT = "act"
+
+// actWindowSize buckets the Camli-ACT challenge into coarse time
+// slots, so a proof is valid for a short, clock-skew-tolerant window
+// instead of needing a separate challenge round trip before every
+// fetch.
+const actWindowSize = 5 * time.Minute
+
+func actWindow(t time.Time) int64 {
+	return t.Unix() / int64(actWindowSize/time.Second)
+}
+
+// actChallenge is the value a Camli-ACT proof must cover. Binding it
+// to both the target and the time window means a proof captured for
+// one share, or for one window, can't be replayed against another.
+func actChallenge(target blob.Ref, window int64) [32]byte {
+	return sha256.Sum256([]byte(fmt.Sprintf("camli-act-challenge:%s:%d", target, window)))
+}
+
+func actNonce(challenge [32]byte) [24]byte {
+	sum := sha256.Sum256(append([]byte("camli-act-nonce:"), challenge[:]...))
+	var n [24]byte
+	copy(n[:], sum[:24])
+	return n
+}
+
+// ACTPublicKey returns the public half of the server's ACT keypair,
+// derived from the configured private key, and whether ACT shares are
+// enabled at all. It's what serveACTKey hands out at actKeyPath, and
+// what checkACTAuth below expects proofs to be sealed to.
+func (sh *shareHandler) ACTPublicKey() (pub [32]byte, ok bool) {
+	if sh.actKey == nil {
+		return pub, false
+	}
+	curve25519.ScalarBaseMult(&pub, sh.actKey)
+	return pub, true
+}
+
+// serveACTKey serves a GET at actKeyPath: the server's ACT public key,
+// hex-encoded, as a bare text/plain response. A client fetches this
+// once (it's static for as long as the server's shareACTKey config
+// isn't rotated) before it ever needs to construct a Camli-ACT proof.
+func (sh *shareHandler) serveACTKey(w http.ResponseWriter, r *http.Request) {
+	pub, ok := sh.ACTPublicKey()
+	if !ok {
+		http.Error(w, "ACT shares are not enabled on this server", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	io.WriteString(w, hex.EncodeToString(pub[:]))
+}
+
+// checkACTAuth verifies a "Authorization: Camli-ACT <pubkey> <proof>"
+// header against manifest, reporting whether the requester has proven
+// they hold the private key for one of manifest's grants.
+//
+// The header names one of manifest's grants by its public key and
+// carries, as "proof", a NaCl box: the client seals the current
+// window's challenge to sh.actKey's public half, naming themselves
+// (their own public key) as the box's sender. box.Open only succeeds
+// if the ciphertext was produced by the private key matching that
+// claimed sender, so a successful open - whose plaintext is the
+// expected challenge - is exactly the proof of possession a detached
+// signature would give, without asking recipients to hold a second,
+// signature-only keypair alongside the X25519 key their grant is
+// already sealed to.
+func (sh *shareHandler) checkACTAuth(r *http.Request, manifest *schema.ACTManifest, target blob.Ref) bool {
+	if sh.actKey == nil {
+		return false
+	}
+	const prefix = "Camli-ACT "
+	auth := r.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, prefix) {
+		return false
+	}
+	fields := strings.Fields(strings.TrimPrefix(auth, prefix))
+	if len(fields) != 2 {
+		return false
+	}
+	pubHex, proofHex := fields[0], fields[1]
+	if !manifest.HasGrant(pubHex) {
+		return false
+	}
+	pubBytes, err := hex.DecodeString(pubHex)
+	if err != nil || len(pubBytes) != 32 {
+		return false
+	}
+	var pub [32]byte
+	copy(pub[:], pubBytes)
+	proof, err := hex.DecodeString(proofHex)
+	if err != nil {
+		return false
+	}
+
+	now := time.Now()
+	for _, window := range []int64{actWindow(now), actWindow(now.Add(-actWindowSize))} {
+		challenge := actChallenge(target, window)
+		nonce := actNonce(challenge)
+		opened, ok := box.Open(nil, proof, &nonce, &pub, sh.actKey)
+		if ok && string(opened) == string(challenge[:]) {
+			return true
+		}
+	}
+	return false
+}
+
+// serveACTShare serves a ShareACT share: manifestRef names the
+// access-control manifest listing authorized recipients, and its
+// Target is the blob holding the secretbox-sealed share content (see
+// schema.SealPayload) that the caller ultimately wants to read.
+//
+// Unlike other share types, the server can't just fetch and stream
+// target: its bytes are sealed under the manifest's session key, and
+// every grant of that key is itself sealed (via box.SealAnonymous) to
+// a recipient's public key, openable only with that recipient's own
+// private key - which the server never has. So a successful
+// checkACTAuth only proves the requester holds a granted private key;
+// it doesn't hand the server anything it can decrypt target with. The
+// requester's own client must recover the session key locally (via
+// manifest.SessionKeyFor) and forward it in actSessionKeyHeader; this
+// handler's job is then just to check that the forwarded key actually
+// opens target, and serve the result.
+func (sh *shareHandler) serveACTShare(w http.ResponseWriter, r *http.Request, manifestRef blob.Ref) {
+	rc, _, err := sh.fetcher.Fetch(r.Context(), manifestRef)
+	if err != nil {
+		http.Error(w, "access-control manifest not found", http.StatusNotFound)
+		return
+	}
+	data, err := ioutil.ReadAll(rc)
+	rc.Close()
+	if err != nil {
+		http.Error(w, "error reading access-control manifest", http.StatusInternalServerError)
+		return
+	}
+	manifest, err := schema.ParseACTManifest(data)
+	if err != nil {
+		http.Error(w, "invalid access-control manifest", http.StatusInternalServerError)
+		return
+	}
+	target, ok := blob.Parse(manifest.Target)
+	if !ok {
+		http.Error(w, "invalid access-control manifest", http.StatusInternalServerError)
+		return
+	}
+
+	if !sh.checkACTAuth(r, manifest, target) {
+		w.Header().Set("WWW-Authenticate", "Camli-ACT")
+		http.Error(w, "missing or invalid Camli-ACT authorization", http.StatusUnauthorized)
+		return
+	}
+
+	sessionKey, err := hex.DecodeString(r.Header.Get(actSessionKeyHeader))
+	if err != nil || len(sessionKey) == 0 {
+		http.Error(w, "missing or invalid "+actSessionKeyHeader+" header", http.StatusBadRequest)
+		return
+	}
+
+	sealed, _, err := sh.fetcher.Fetch(r.Context(), target)
+	if err != nil {
+		http.Error(w, "share target not found", http.StatusNotFound)
+		return
+	}
+	sealedBytes, err := ioutil.ReadAll(sealed)
+	sealed.Close()
+	if err != nil {
+		http.Error(w, "error reading share target", http.StatusInternalServerError)
+		return
+	}
+	plaintext, err := schema.OpenPayload(sessionKey, sealedBytes)
+	if err != nil {
+		http.Error(w, "session key does not decrypt share target", http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	io.Copy(w, bytes.NewReader(plaintext))
+}
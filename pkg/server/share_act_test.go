@@ -0,0 +1,316 @@
+/*
+Copyright 2026 The Perkeep Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"perkeep.org/pkg/blob"
+	"perkeep.org/pkg/schema"
+
+	"golang.org/x/crypto/nacl/box"
+)
+
+func actAuthHeader(t *testing.T, serverPub, recipientPriv *[32]byte, recipientPub *[32]byte, target blob.Ref) string {
+	t.Helper()
+	challenge := actChallenge(target, actWindow(time.Now()))
+	nonce := actNonce(challenge)
+	proof := box.Seal(nil, challenge[:], &nonce, serverPub, recipientPriv)
+	return "Camli-ACT " + hex.EncodeToString(recipientPub[:]) + " " + hex.EncodeToString(proof)
+}
+
+func TestCheckACTAuth(t *testing.T) {
+	serverPub, serverPriv, err := box.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	recipientPub, recipientPriv, err := box.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	target := blob.RefFromBytes([]byte("act target"))
+	manifest, _, err := schema.NewACTManifest(target, *recipientPub)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sh := &shareHandler{actKey: serverPriv}
+
+	req := httptest.NewRequest("GET", "/share/whatever", nil)
+	req.Header.Set("Authorization", actAuthHeader(t, serverPub, recipientPriv, recipientPub, target))
+	if !sh.checkACTAuth(req, manifest, target) {
+		t.Error("valid Camli-ACT proof should authenticate")
+	}
+}
+
+func TestCheckACTAuth_RejectsUnknownGrant(t *testing.T) {
+	serverPub, serverPriv, err := box.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	grantedPub, _, err := box.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	strangerPub, strangerPriv, err := box.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	target := blob.RefFromBytes([]byte("act target"))
+	manifest, _, err := schema.NewACTManifest(target, *grantedPub)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sh := &shareHandler{actKey: serverPriv}
+	req := httptest.NewRequest("GET", "/share/whatever", nil)
+	req.Header.Set("Authorization", actAuthHeader(t, serverPub, strangerPriv, strangerPub, target))
+	if sh.checkACTAuth(req, manifest, target) {
+		t.Error("a proof from a key with no grant should not authenticate")
+	}
+}
+
+func TestCheckACTAuth_RejectsMissingHeader(t *testing.T) {
+	_, serverPriv, err := box.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	recipientPub, _, err := box.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	target := blob.RefFromBytes([]byte("act target"))
+	manifest, _, err := schema.NewACTManifest(target, *recipientPub)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sh := &shareHandler{actKey: serverPriv}
+	req := httptest.NewRequest("GET", "/share/whatever", nil)
+	if sh.checkACTAuth(req, manifest, target) {
+		t.Error("a request with no Authorization header should not authenticate")
+	}
+}
+
+func TestCheckACTAuth_DisabledWithoutServerKey(t *testing.T) {
+	sh := &shareHandler{}
+	req := httptest.NewRequest("GET", "/share/whatever", nil)
+	req.Header.Set("Authorization", "Camli-ACT deadbeef cafebabe")
+	if sh.checkACTAuth(req, &schema.ACTManifest{}, blob.RefFromBytes([]byte("x"))) {
+		t.Error("checkACTAuth should always fail when the handler has no actKey configured")
+	}
+}
+
+// TestACTPublicKey_UsableByARealClient checks that a client who only
+// knows the server's ACT public key via ACTPublicKey/serveACTKey -
+// not, as the other tests here do, by generating both halves of the
+// server's keypair itself - can still produce a proof checkACTAuth
+// accepts.
+func TestACTPublicKey_UsableByARealClient(t *testing.T) {
+	_, serverPriv, err := box.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sh := &shareHandler{actKey: serverPriv}
+	discoveredPub, ok := sh.ACTPublicKey()
+	if !ok {
+		t.Fatal("ACTPublicKey should be available once actKey is configured")
+	}
+
+	recipientPub, recipientPriv, err := box.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	target := blob.RefFromBytes([]byte("act target"))
+	manifest, _, err := schema.NewACTManifest(target, *recipientPub)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := httptest.NewRequest("GET", "/share/whatever", nil)
+	req.Header.Set("Authorization", actAuthHeader(t, &discoveredPub, recipientPriv, recipientPub, target))
+	if !sh.checkACTAuth(req, manifest, target) {
+		t.Error("a proof sealed to the discovered ACTPublicKey should authenticate")
+	}
+}
+
+// fetcherFunc adapts a func to the blob.Fetcher interface sh.fetcher
+// needs, so this test can serve manifestRef/target without pulling in
+// a full blobserver.Storage implementation.
+type fetcherFunc func(ctx context.Context, br blob.Ref) (io.ReadCloser, uint32, error)
+
+func (f fetcherFunc) Fetch(ctx context.Context, br blob.Ref) (io.ReadCloser, uint32, error) {
+	return f(ctx, br)
+}
+
+func TestServeACTShare(t *testing.T) {
+	serverPub, serverPriv, err := box.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	recipientPub, recipientPriv, err := box.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	plaintext := []byte("shared content, end to end")
+	sessionKey, err := schema.GenerateSessionKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sealed, err := schema.SealPayload(sessionKey, plaintext)
+	if err != nil {
+		t.Fatal(err)
+	}
+	target := blob.RefFromBytes(sealed)
+
+	manifest, err := schema.NewACTManifestForSessionKey(target, sessionKey, *recipientPub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	manifestData, err := manifest.Encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	manifestRef := blob.RefFromBytes(manifestData)
+
+	blobs := map[blob.Ref][]byte{
+		manifestRef: manifestData,
+		target:      sealed,
+	}
+	sh := &shareHandler{
+		actKey: serverPriv,
+		fetcher: fetcherFunc(func(ctx context.Context, br blob.Ref) (io.ReadCloser, uint32, error) {
+			data, ok := blobs[br]
+			if !ok {
+				return nil, 0, os.ErrNotExist
+			}
+			return ioutil.NopCloser(bytes.NewReader(data)), uint32(len(data)), nil
+		}),
+	}
+
+	// Recover the session key the way a real recipient's client would:
+	// locally, from the manifest and their own private key, never
+	// asking the server to do it.
+	recoveredKey, ok := manifest.SessionKeyFor(recipientPub, recipientPriv)
+	if !ok {
+		t.Fatal("SessionKeyFor failed to recover the session key")
+	}
+
+	req := httptest.NewRequest("GET", "/share/"+manifestRef.String(), nil)
+	req.Header.Set("Authorization", actAuthHeader(t, serverPub, recipientPriv, recipientPub, target))
+	req.Header.Set(actSessionKeyHeader, hex.EncodeToString(recoveredKey))
+
+	rr := httptest.NewRecorder()
+	sh.serveACTShare(rr, req, manifestRef)
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("status = %d, want 200: %s", rr.Code, rr.Body.String())
+	}
+	if got := rr.Body.Bytes(); !bytes.Equal(got, plaintext) {
+		t.Fatalf("served body = %q, want %q", got, plaintext)
+	}
+}
+
+func TestServeACTShare_RejectsMissingSessionKeyHeader(t *testing.T) {
+	serverPub, serverPriv, err := box.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	recipientPub, recipientPriv, err := box.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sessionKey, err := schema.GenerateSessionKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sealed, err := schema.SealPayload(sessionKey, []byte("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	target := blob.RefFromBytes(sealed)
+	manifest, err := schema.NewACTManifestForSessionKey(target, sessionKey, *recipientPub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	manifestData, err := manifest.Encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	manifestRef := blob.RefFromBytes(manifestData)
+
+	blobs := map[blob.Ref][]byte{manifestRef: manifestData, target: sealed}
+	sh := &shareHandler{
+		actKey: serverPriv,
+		fetcher: fetcherFunc(func(ctx context.Context, br blob.Ref) (io.ReadCloser, uint32, error) {
+			data, ok := blobs[br]
+			if !ok {
+				return nil, 0, os.ErrNotExist
+			}
+			return ioutil.NopCloser(bytes.NewReader(data)), uint32(len(data)), nil
+		}),
+	}
+
+	req := httptest.NewRequest("GET", "/share/"+manifestRef.String(), nil)
+	req.Header.Set("Authorization", actAuthHeader(t, serverPub, recipientPriv, recipientPub, target))
+	// Deliberately no actSessionKeyHeader.
+
+	rr := httptest.NewRecorder()
+	sh.serveACTShare(rr, req, manifestRef)
+	if rr.Code != http.StatusBadRequest {
+		t.Fatalf("status = %d, want 400 without a session key header", rr.Code)
+	}
+}
+
+func TestServeACTKey(t *testing.T) {
+	_, serverPriv, err := box.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sh := &shareHandler{actKey: serverPriv}
+	pub, _ := sh.ACTPublicKey()
+
+	rr := httptest.NewRecorder()
+	sh.serveACTKey(rr, httptest.NewRequest("GET", "/share/"+actKeyPath, nil))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("status = %d, want 200", rr.Code)
+	}
+	if got, want := rr.Body.String(), hex.EncodeToString(pub[:]); got != want {
+		t.Errorf("served ACT key = %q, want %q", got, want)
+	}
+}
+
+func TestServeACTKey_DisabledWithoutServerKey(t *testing.T) {
+	sh := &shareHandler{}
+	rr := httptest.NewRecorder()
+	sh.serveACTKey(rr, httptest.NewRequest("GET", "/share/"+actKeyPath, nil))
+	if rr.Code != http.StatusNotFound {
+		t.Errorf("status = %d, want 404 when ACT shares are disabled", rr.Code)
+	}
+}
@@ -0,0 +1,144 @@
+/*
+Copyright 2026 The Perkeep Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"perkeep.org/pkg/blob"
+	"perkeep.org/pkg/blobserver/handlers"
+
+	"go4.org/jsonconfig"
+)
+
+func TestShareHandler_SignBlobRefWithoutSigningFails(t *testing.T) {
+	sh := &shareHandler{}
+	if _, err := sh.SignBlobRef(blob.RefFromBytes([]byte("x")), time.Minute, "claim"); err == nil {
+		t.Fatal("SignBlobRef should fail when no signing secret is configured")
+	}
+}
+
+func TestShareHandler_SignBlobRefRoundTrips(t *testing.T) {
+	secrets := handlers.SigningSecrets{Current: "k1", Keys: map[string][]byte{"k1": []byte("secret")}}
+	sh := &shareHandler{signing: secrets}
+	ref := blob.RefFromBytes([]byte("embedded content"))
+
+	qs, err := sh.SignBlobRef(ref, time.Minute, "claim-abc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	v, err := url.ParseQuery(qs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	exp, err := strconv.ParseInt(v.Get("exp"), 16, 64)
+	if err != nil {
+		t.Fatalf("exp %q didn't parse as hex unix time: %v", v.Get("exp"), err)
+	}
+	if !secrets.Verify(ref, v.Get("sig"), exp, v.Get("sub")) {
+		t.Error("signature minted by SignBlobRef should verify against the same secrets")
+	}
+	if v.Get("sub") != "claim-abc" {
+		t.Errorf("sub = %q, want %q", v.Get("sub"), "claim-abc")
+	}
+}
+
+func TestSigningSecretsFromConfig(t *testing.T) {
+	secrets, err := signingSecretsFromConfig(jsonconfig.Obj{
+		"current": "2026-07",
+		"keys": map[string]interface{}{
+			"2026-07": "68656c6c6f", // "hello"
+			"2026-01": "776f726c64", // "world"
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if secrets.Current != "2026-07" {
+		t.Errorf("Current = %q, want %q", secrets.Current, "2026-07")
+	}
+	if len(secrets.Keys) != 2 {
+		t.Errorf("got %d keys, want 2", len(secrets.Keys))
+	}
+}
+
+func TestSigningSecretsFromConfig_Empty(t *testing.T) {
+	secrets, err := signingSecretsFromConfig(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !secrets.Zero() {
+		t.Error("empty config should produce a disabled (zero) SigningSecrets")
+	}
+}
+
+func TestSigningSecretsFromConfig_UnknownCurrent(t *testing.T) {
+	_, err := signingSecretsFromConfig(jsonconfig.Obj{
+		"current": "missing",
+		"keys": map[string]interface{}{
+			"2026-07": "68656c6c6f",
+		},
+	})
+	if err == nil {
+		t.Fatal(`expected an error when "current" has no matching "keys" entry`)
+	}
+}
+
+func TestSigningSecretsFromConfig_SigBytes(t *testing.T) {
+	secrets, err := signingSecretsFromConfig(jsonconfig.Obj{
+		"current": "2026-07",
+		"keys": map[string]interface{}{
+			"2026-07": "68656c6c6f",
+		},
+		"sigBytes": float64(16),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if secrets.SigBytes != 16 {
+		t.Errorf("SigBytes = %d, want 16", secrets.SigBytes)
+	}
+
+	ref := blob.RefFromString("some-blob")
+	token, err := secrets.Sign(ref, time.Now().Add(time.Hour), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, sigHex, _ := strings.Cut(token, ":")
+	if got := len(sigHex); got != 32 { // 16 bytes, hex-encoded
+		t.Errorf("signed token has %d hex chars, want 32", got)
+	}
+}
+
+func TestSigningSecretsFromConfig_SigBytesOutOfRange(t *testing.T) {
+	for _, sigBytes := range []float64{-1, 33} {
+		_, err := signingSecretsFromConfig(jsonconfig.Obj{
+			"current": "2026-07",
+			"keys": map[string]interface{}{
+				"2026-07": "68656c6c6f",
+			},
+			"sigBytes": sigBytes,
+		})
+		if err == nil {
+			t.Errorf("sigBytes=%v: expected an error, got none", sigBytes)
+		}
+	}
+}